@@ -3,57 +3,270 @@ package xss
 import (
 	"bytes"
 	"github.com/gin-gonic/gin"
+	"github.com/microcosm-cc/bluemonday"
 	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
 	"strings"
 )
 
+// heldResponse holds back the status and body written to a response until they are filtered, or until the body
+// grows past limit and is streamed unfiltered, after calling beforeStream
+type heldResponse struct {
+	body         *bytes.Buffer
+	status       int
+	limit        int64
+	beforeStream func()
+	streaming    bool
+}
+
+// write holds b back, or sends it to w once streaming, along with the status and body held back so far
+func (h *heldResponse) write(w http.ResponseWriter, b []byte) (int, error) {
+	if !h.streaming && h.limit > 0 && int64(h.body.Len()+len(b)) > h.limit {
+		h.streaming = true
+		if h.beforeStream != nil {
+			h.beforeStream()
+		}
+		if h.status != 0 {
+			w.WriteHeader(h.status)
+		}
+		if _, err := w.Write(h.body.Bytes()); err != nil {
+			return 0, err
+		}
+		h.body.Reset()
+	}
+	if h.streaming {
+		return w.Write(b)
+	}
+	return h.body.Write(b)
+}
+
+// streamUnfiltered is the beforeStream of the response to req: it logs that the body is sent unfiltered, and
+// sanitizes its header while it can still be changed
+func (p *Defender) streamUnfiltered(req *http.Request, header http.Header) func() {
+	return func() {
+		p.logger.Infof("xss: %s %s response larger than %d bytes, sent unfiltered", req.Method, req.URL.Path, p.responseBufferLimit)
+		p.sanitizeResponseHeaders(header)
+	}
+}
+
 type BodyWriter struct {
 	gin.ResponseWriter
-	body *bytes.Buffer
+	heldResponse
+}
+
+func (w *BodyWriter) Write(b []byte) (int, error) {
+	return w.write(w.ResponseWriter, b)
+}
+
+func (w *BodyWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// WriteHeader holds the code back, it is replayed once the filtered body is flushed
+func (w *BodyWriter) WriteHeader(code int) {
+	if w.streaming {
+		return
+	}
+	w.status = code
 }
 
-func (w BodyWriter) Write(b []byte) (int, error) {
-	return w.body.Write(b)
+func (w *BodyWriter) WriteHeaderNow() {}
+
+// Flush does nothing while the body is held back, the held status and filtered body are sent once the handler
+// returns. Once streaming, it flushes the response.
+func (w *BodyWriter) Flush() {
+	if w.streaming {
+		w.ResponseWriter.Flush()
+	}
 }
 
+func (w *BodyWriter) Status() int {
+	if w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+// FilterXSS sanitizes JSON response bodies, once per request even when registered twice with the same Defender
 func (p *Defender) FilterXSS() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
+		if p.isSkipRequest(ctx.Request) || ctx.GetBool(SkipContextKey) {
+			ctx.Next()
+			return
+		}
+		if done, ok := ctx.Get(filteredKey); ok && done == p {
+			ctx.Next()
+			return
+		}
+		ctx.Set(filteredKey, p)
+
 		w := &BodyWriter{
-			body:           &bytes.Buffer{},
 			ResponseWriter: ctx.Writer,
+			heldResponse: heldResponse{
+				body:         &bytes.Buffer{},
+				limit:        p.responseBufferLimit,
+				beforeStream: p.streamUnfiltered(ctx.Request, ctx.Writer.Header()),
+			},
 		}
 		ctx.Writer = w
 
 		ctx.Next()
-
-		oldBody := w.body
-
-		respContentTp := ctx.Writer.Header().Get("content-type")
-		// 不处理非 json 响应体
-		if !strings.Contains(respContentTp, "application/json") {
-			w.ResponseWriter.WriteString(oldBody.String())
-			w.body.Reset()
+		ctx.Writer = w.ResponseWriter
+		if w.streaming {
 			return
 		}
 
-		newBody, err := p.BuildNewBody(oldBody)
+		p.sanitizeResponseHeaders(ctx.Writer.Header())
+		raw := w.body.Bytes()
+		newBody, err := p.filterBody(w.status, ctx.Writer.Header(), w.body)
 		if err != nil {
 			ctx.AbortWithError(500, errXSSFilter)
 			return
 		}
 
+		setContentLength(ctx.Writer.Header(), raw, newBody)
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
 		w.ResponseWriter.WriteString(newBody.String())
 		w.body.Reset()
 	}
 }
 
+// setContentLength sets the Content-Length of a filtered body that changed from raw, or that had none. The length
+// a handler set for a body left as it was stands, e.g. that of a HEAD response, which has no body.
+func setContentLength(header http.Header, raw []byte, body *bytes.Buffer) {
+	if bytes.Equal(raw, body.Bytes()) && header.Get("Content-Length") != "" {
+		return
+	}
+	header.Set("Content-Length", strconv.Itoa(body.Len()))
+}
+
+// sanitizeResponseHeaders cleans the values of the response headers set with SetSanitizeResponseHeaders
+func (p *Defender) sanitizeResponseHeaders(header http.Header) {
+	for _, name := range p.responseHeaderNames {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(name)
+		for _, value := range values {
+			// CR and LF would split the header, other control characters hide a scheme from url.Parse
+			value = strings.Map(func(r rune) rune {
+				if r < 0x20 || r == 0x7f {
+					return -1
+				}
+				return r
+			}, value)
+			if name == "Refresh" {
+				value = cleanRefresh(value)
+			} else {
+				value = cleanURL(value)
+			}
+			if value != "" {
+				header.Add(name, value)
+			}
+		}
+	}
+}
+
+// cleanRefresh returns a Refresh header value, a delay optionally followed by "; url=" and a URL, with its URL
+// checked like by cleanURL, an empty string when either part is invalid
+func cleanRefresh(value string) string {
+	delay, target := value, ""
+	if i := strings.IndexAny(value, ";,"); i >= 0 {
+		delay, target = value[:i], strings.TrimSpace(value[i+1:])
+	}
+	delay = strings.TrimSpace(delay)
+	if delay == "" || strings.Trim(delay, "0123456789.") != "" {
+		return ""
+	}
+	if len(target) > 3 && strings.EqualFold(target[:3], "url") && strings.HasPrefix(strings.TrimSpace(target[3:]), "=") {
+		target = strings.TrimSpace(strings.TrimSpace(target[3:])[1:])
+	}
+	if len(target) >= 2 && (target[0] == '\'' || target[0] == '"') && target[len(target)-1] == target[0] {
+		target = target[1 : len(target)-1]
+	}
+	if target == "" {
+		return delay
+	}
+	if target = cleanURL(target); target == "" {
+		return ""
+	}
+	return delay + "; url=" + target
+}
+
+// filterBody returns the sanitized version of a response body sent with status and header
+func (p *Defender) filterBody(status int, header http.Header, body *bytes.Buffer) (_ *bytes.Buffer, err error) {
+	defer wrapError(&err, "response")
+	// the reporter of SetReportOnly is told about requests only, responses are filtered all the same
+	p = p.quiet()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// 默认不处理非 2xx 响应体
+	if !p.filterErrorResponses && (status < 200 || status > 299) {
+		return body, nil
+	}
+
+	// nothing to do with a response policy keeping everything
+	if p.responsePolicy == identityPolicy {
+		return body, nil
+	}
+
+	respContentTp := header.Get("content-type")
+	// 不处理非 json 响应体
+	if !p.isFilteredResponse(respContentTp) {
+		return body, nil
+	}
+
+	raw := body.Bytes()
+	if !isJsonMediaType(respContentTp) {
+		// e.g. HTML fragments, sanitized as a whole
+		return bytes.NewBufferString(sanitizeWith(p.responseBodyPolicy(), body.String())), nil
+	}
+
+	newBody, err := p.BuildNewBody(body)
+	if err == errNotJson {
+		// a handler bug, not ours to hide behind a 500
+		p.logger.Infof("xss: response is not valid JSON despite its content type %q, sent unfiltered", respContentTp)
+		return bytes.NewBuffer(raw), nil
+	}
+	return newBody, err
+}
+
+// isFilteredResponse reports whether responses of contentType are filtered, JSON ones unless SetResponseContentTypes
+// says otherwise
+func (p *Defender) isFilteredResponse(contentType string) bool {
+	if p.responseTypes == nil {
+		return isJsonMediaType(contentType)
+	}
+	mt := mediaType(contentType)
+	for _, t := range p.responseTypes {
+		if strings.EqualFold(t, mt) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseBodyPolicy is the policy response bodies are sanitized with
+func (p *Defender) responseBodyPolicy() *bluemonday.Policy {
+	if p.responsePolicy != nil {
+		return p.responsePolicy
+	}
+	return p.policy
+}
+
+// BuildNewBody returns the sanitized version of the JSON document in body, an object, an array or a scalar
 func (p *Defender) BuildNewBody(body *bytes.Buffer) (*bytes.Buffer, error) {
-	jsonBod, err := decodeJson(body)
+	jsonBod, err := decodeJson(body, p.maxJSONDepth, p.duplicateKeys)
 	if err != nil {
 		return nil, err
 	}
 
-	buff, err := p.jsonToStringMap(jsonBod)
+	buff, err := p.jsonToStringMap(jsonBod, p.responseBodyPolicy())
 	if err != nil {
 		return nil, err
 	}
@@ -63,3 +276,10 @@ func (p *Defender) BuildNewBody(body *bytes.Buffer) (*bytes.Buffer, error) {
 
 var errNotJson = errors.New("response is not a valid json")
 var errXSSFilter = errors.New("xss 处理失败")
+var errNoBoundary = errors.New("multipart body without boundary")
+var errTooDeep = errors.New("json nested too deeply")
+var errTooManyParams = errors.New("too many query parameters")
+var errPartTooLarge = errors.New("multipart part too large")
+var errTooManyParts = errors.New("too many multipart parts")
+var errNotPointer = errors.New("SanitizeStruct needs a non-nil pointer")
+var errDuplicateKey = errors.New("duplicate json key")
@@ -0,0 +1,75 @@
+package xss
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// RemoveXSSHTTP is the net/http counterpart of RemoveXSS, requests that can't be sanitized get a 400
+// or the status set with SetRejectOnModification
+func (p *Defender) RemoveXSSHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.isSkipRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, err := p.sanitizeRequest(r); err != nil {
+			status := p.errorStatus(err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FilterXSSHTTP is the net/http counterpart of FilterXSS
+func (p *Defender) FilterXSSHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.isSkipRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &responseBuffer{ResponseWriter: w, heldResponse: heldResponse{
+			body:         &bytes.Buffer{},
+			limit:        p.responseBufferLimit,
+			beforeStream: p.streamUnfiltered(r, w.Header()),
+		}}
+
+		next.ServeHTTP(rw, r)
+		if rw.streaming {
+			return
+		}
+
+		p.sanitizeResponseHeaders(w.Header())
+		raw := rw.body.Bytes()
+		newBody, err := p.filterBody(rw.status, w.Header(), rw.body)
+		if err != nil {
+			http.Error(w, errXSSFilter.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setContentLength(w.Header(), raw, newBody)
+		if rw.status != 0 {
+			w.WriteHeader(rw.status)
+		}
+		w.Write(newBody.Bytes())
+	})
+}
+
+// responseBuffer holds back the status and body written by a handler until they are filtered, see heldResponse
+type responseBuffer struct {
+	http.ResponseWriter
+	heldResponse
+}
+
+func (w *responseBuffer) WriteHeader(code int) {
+	if w.status == 0 && !w.streaming {
+		w.status = code
+	}
+}
+
+func (w *responseBuffer) Write(b []byte) (int, error) {
+	return w.write(w.ResponseWriter, b)
+}
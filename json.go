@@ -0,0 +1,156 @@
+package xss
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// jsonField is a member of a decoded JSON object
+type jsonField struct {
+	key   string
+	value interface{}
+}
+
+// jsonObject is a decoded JSON object keeping its members in the order they were sent
+type jsonObject []jsonField
+
+// MarshalJSON writes the members of obj in order
+func (obj jsonObject) MarshalJSON() ([]byte, error) {
+	var buff bytes.Buffer
+	buff.WriteByte('{')
+	for i, field := range obj {
+		if i > 0 {
+			buff.WriteByte(',')
+		}
+		key, _ := marshalJson(field.key)
+		value, err := marshalJson(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buff.WriteString(key)
+		buff.WriteByte(':')
+		buff.WriteString(value)
+	}
+	buff.WriteByte('}')
+	return buff.Bytes(), nil
+}
+
+// marshalJson returns the JSON encoding of v, leaving '<', '>' and '&' alone
+func marshalJson(v interface{}) (string, error) {
+	var buff bytes.Buffer
+	enc := json.NewEncoder(&buff)
+	// sanitized values are full of entities, no need to turn their '&' into \u0026
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buff.String(), "\n"), nil
+}
+
+// sortedObject turns mp into a jsonObject ordered by key, so that it is written deterministically
+func sortedObject(mp map[string]interface{}) jsonObject {
+	keys := make([]string, 0, len(mp))
+	for k := range mp {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	obj := make(jsonObject, 0, len(mp))
+	for _, k := range keys {
+		obj = append(obj, jsonField{key: k, value: mp[k]})
+	}
+	return obj
+}
+
+// decodeValue reads the next JSON value from d. Objects become jsonObject, arrays []interface{},
+// other values are returned as the tokens of d. Objects and arrays may nest depth levels deep, any number when
+// depth is negative. Members sharing a key are handled according to duplicates.
+func decodeValue(d *json.Decoder, depth int, duplicates DuplicateKeyPolicy) (interface{}, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+	if depth == 0 {
+		return nil, errTooDeep
+	}
+
+	switch delim {
+	case '{':
+		obj := jsonObject{}
+		var seen map[string]int // index in obj of each key
+		if duplicates != KeepAllKeys {
+			seen = map[string]int{}
+		}
+		for d.More() {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeValue(d, depth-1, duplicates)
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			if i, ok := seen[key]; ok {
+				switch duplicates {
+				case RejectDuplicateKeys:
+					return nil, &XSSError{Phase: "json", Field: key, Err: errDuplicateKey}
+				case KeepLastKey:
+					obj[i].value = value
+				}
+				continue
+			}
+			if seen != nil {
+				seen[key] = len(obj)
+			}
+			obj = append(obj, jsonField{key: key, value: value})
+		}
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case '[':
+		arr := []interface{}{}
+		for d.More() {
+			value, err := decodeValue(d, depth-1, duplicates)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	default:
+		return nil, errors.New("unexpected " + delim.String())
+	}
+}
+
+// indentLike returns the compact JSON document out indented the way the document in was, e.g. with two spaces
+// per level. Compact documents stay compact, as does out when in can't be matched.
+func indentLike(in, out []byte) []byte {
+	nl := bytes.IndexByte(in, '\n')
+	if nl < 0 {
+		return out
+	}
+	indent := in[nl+1:]
+	indent = indent[:len(indent)-len(bytes.TrimLeft(indent, " \t"))]
+
+	var buff bytes.Buffer
+	if err := json.Indent(&buff, out, "", string(indent)); err != nil {
+		return out
+	}
+	if bytes.HasSuffix(bytes.TrimRight(in, " \t\r"), []byte("\n")) {
+		buff.WriteByte('\n')
+	}
+	return buff.Bytes()
+}
@@ -0,0 +1,13 @@
+package xss
+
+// Logger receives what the middlewares did, e.g. for auditing. Both methods take fmt.Printf style arguments.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// nopLogger is the Logger used until SetLogger is given one
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
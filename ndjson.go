@@ -0,0 +1,41 @@
+package xss
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// handleNdjson sanitizes an application/x-ndjson body, each line being a JSON document of its own. Lines keep their
+// order and line endings, blank lines and lines that aren't JSON are written back as they were.
+func (p *Defender) handleNdjson(req *http.Request) (err error) {
+	defer wrapError(&err, "ndjson")
+	if req.Body == nil {
+		return nil
+	}
+	p.limitBody(req)
+
+	var raw bytes.Buffer
+	if _, err := raw.ReadFrom(req.Body); err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	for _, line := range bytes.SplitAfter(raw.Bytes(), []byte("\n")) {
+		content := bytes.TrimRight(line, "\r\n")
+		if len(bytes.TrimSpace(content)) == 0 || !json.Valid(content) {
+			// like a malformed JSON body, a malformed line is left to the handler
+			buff.Write(line)
+			continue
+		}
+		clean, err := p.SanitizeJSONBytes(content)
+		if err != nil {
+			return err
+		}
+		buff.Write(clean)
+		buff.Write(line[len(content):])
+	}
+
+	setBody(req, buff.Bytes())
+	return nil
+}
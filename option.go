@@ -1,12 +1,23 @@
 package xss
 
-import "github.com/microcosm-cc/bluemonday"
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/text/unicode/norm"
+	"net/http"
+	"regexp"
+	"strings"
+)
 
 type Option func(defender *Defender)
 
+// SetSkipFields sets the fields left unsanitized. A dotted path such as "user.apiKey" matches
+// that nested JSON field only, a bare name matches the field at any depth. Objects and arrays are copied verbatim.
+// It replaces the fields set with SetOnlySanitizeFields.
 func SetSkipFields(ss ...string) Option {
 	return func(defender *Defender) {
 		defender.skipFields = ss
+		defender.onlyFields = nil
 	}
 }
 
@@ -15,3 +26,424 @@ func SetPolicy(policy *bluemonday.Policy) Option {
 		defender.policy = policy
 	}
 }
+
+// SetExtraContentTypes registers body handlers keyed by media type, e.g. "text/plain": SanitizeText.
+// They take precedence over the built-in ones; bodies of unknown types remain untouched unless registered.
+func SetExtraContentTypes(handlers map[string]BodyHandler) Option {
+	return func(defender *Defender) {
+		if defender.contentHandlers == nil {
+			defender.contentHandlers = map[string]BodyHandler{}
+		}
+		for contentType, handler := range handlers {
+			defender.contentHandlers[strings.ToLower(contentType)] = handler
+		}
+	}
+}
+
+// SetFieldPolicies sets policies used instead of the default one for the given fields,
+// keyed by field name or dotted path like SetSkipFields. Values nested in such a field inherit its policy.
+func SetFieldPolicies(policies map[string]*bluemonday.Policy) Option {
+	return func(defender *Defender) {
+		defender.fieldPolicies = policies
+	}
+}
+
+// SetTagPolicy registers policy under name for SanitizeStruct, fields tagged `xss:"<name>"` are sanitized with it.
+// "strict", "ugc" and "none" name bluemonday.StrictPolicy, bluemonday.UGCPolicy and IdentityPolicy unless registered.
+func SetTagPolicy(name string, policy *bluemonday.Policy) Option {
+	return func(defender *Defender) {
+		if defender.tagPolicies == nil {
+			defender.tagPolicies = map[string]*bluemonday.Policy{}
+		}
+		defender.tagPolicies[name] = policy
+	}
+}
+
+// SetFieldTransform sets fn to run on the values of field, a name or a dotted path like for SetSkipFields, e.g. to
+// trim or lowercase them. It runs before the policy, which sanitizes what it returns; changes it makes alone are
+// neither reported nor rejected. Skip fields are left alone.
+func SetFieldTransform(field string, fn func(string) string) Option {
+	return func(defender *Defender) {
+		if defender.fieldTransforms == nil {
+			defender.fieldTransforms = map[string]func(string) string{}
+		}
+		defender.fieldTransforms[field] = fn
+	}
+}
+
+// SetErrorHandler sets what RemoveXSS does with a request it fails to sanitize,
+// the request is aborted afterwards. By default it answers 400 with the error message.
+func SetErrorHandler(handler func(*gin.Context, error)) Option {
+	return func(defender *Defender) {
+		defender.errorHandler = handler
+	}
+}
+
+// SetFailOpen makes RemoveXSS and RemoveXSSHTTP log requests they fail to sanitize, e.g. with a malformed multipart
+// body, and pass them on with the body as it was received instead of aborting them. Requests rejected by
+// SetRejectOnModification are still rejected.
+func SetFailOpen(failOpen bool) Option {
+	return func(defender *Defender) {
+		defender.failOpen = failOpen
+	}
+}
+
+// SetFilterErrorResponses makes FilterXSS sanitize responses with a non-2xx status too, they are passed through by default
+func SetFilterErrorResponses(include bool) Option {
+	return func(defender *Defender) {
+		defender.filterErrorResponses = include
+	}
+}
+
+// SetMaxBodyBytes limits the size of request bodies read for sanitization, larger ones fail with an error.
+// Compressed bodies are limited by what they decompress to, 10 MB unless set.
+func SetMaxBodyBytes(n int64) Option {
+	return func(defender *Defender) {
+		defender.maxBodyBytes = n
+	}
+}
+
+// SetSanitizeHeaders sets request headers whose values are sanitized, e.g. ones reflected into pages like Referer.
+// Only the listed headers are touched so structured ones are not corrupted.
+func SetSanitizeHeaders(names ...string) Option {
+	return func(defender *Defender) {
+		defender.sanitizeHeaderNames = nil
+		for _, name := range names {
+			defender.sanitizeHeaderNames = append(defender.sanitizeHeaderNames, http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+// SetResponseBufferLimit makes FilterXSS stream response bodies growing past n bytes as they are written, unfiltered,
+// instead of holding them in memory, e.g. for large exports. Such responses are logged. There is no limit by default.
+func SetResponseBufferLimit(n int64) Option {
+	return func(defender *Defender) {
+		defender.responseBufferLimit = n
+	}
+}
+
+// SetSanitizeResponseHeaders sets URL valued response headers FilterXSS cleans, e.g. Location or Refresh built from
+// user input. Control characters are removed, then values which aren't relative, http, https or mailto URLs are
+// dropped like with SetSkipURLFields, the URL following the delay of a Refresh value is checked alike. Headers are
+// cleaned whatever the status of the response.
+func SetSanitizeResponseHeaders(names ...string) Option {
+	return func(defender *Defender) {
+		defender.responseHeaderNames = nil
+		for _, name := range names {
+			defender.responseHeaderNames = append(defender.responseHeaderNames, http.CanonicalHeaderKey(name))
+		}
+	}
+}
+
+// SetSanitizeCookies sets request cookies whose values are sanitized, other cookies are kept verbatim
+func SetSanitizeCookies(names ...string) Option {
+	return func(defender *Defender) {
+		defender.sanitizeCookieNames = names
+	}
+}
+
+// SetStreamingJSON makes JSON request bodies sanitized token by token rather than decoded into memory first,
+// which suits large bodies. Malformed JSON then fails the request instead of reaching the handler.
+func SetStreamingJSON(streaming bool) Option {
+	return func(defender *Defender) {
+		defender.streamingJSON = streaming
+	}
+}
+
+// SetReportOnly turns the middleware into a dry run: requests are left unchanged and reporter is called
+// for every value sanitization would alter, with the field it was found in and its value before and after.
+// It applies to RemoveXSS, responses are still filtered by FilterXSS and not reported.
+func SetReportOnly(reporter func(field, before, after string)) Option {
+	return func(defender *Defender) {
+		defender.reporter = reporter
+	}
+}
+
+// SetRejectOnModification makes RemoveXSS refuse requests that sanitization would alter instead of cleaning them,
+// failing with a *ModifiedError naming the first offending field. The default error handler answers with status,
+// 400 when none is given.
+func SetRejectOnModification(reject bool, status ...int) Option {
+	return func(defender *Defender) {
+		defender.rejectOnModification = reject
+		if len(status) > 0 {
+			defender.rejectStatus = status[0]
+		}
+	}
+}
+
+// SetSkipPaths sets request paths the middlewares leave alone, e.g. webhooks receiving signed payloads.
+// A path ending with "*" matches every path starting with what precedes it, others must match exactly.
+func SetSkipPaths(paths ...string) Option {
+	return func(defender *Defender) {
+		defender.skipPaths = paths
+	}
+}
+
+// SetSkipFieldPatterns sets glob patterns, e.g. "*_html", for fields left unsanitized.
+// Patterns match the field name at any depth, "*" standing for any run of characters and "?" for one.
+func SetSkipFieldPatterns(patterns ...string) Option {
+	return func(defender *Defender) {
+		defender.skipFieldPatterns = nil
+		for _, pattern := range patterns {
+			defender.skipFieldPatterns = append(defender.skipFieldPatterns, compileGlob(pattern))
+		}
+	}
+}
+
+// compileGlob turns a glob pattern into the regexp matching the same whole strings
+func compileGlob(pattern string) *regexp.Regexp {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, `.*`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	return regexp.MustCompile(`^` + expr + `$`)
+}
+
+// SetLogger sets the Logger told about every request the middlewares altered or refused, nothing is logged by default
+func SetLogger(logger Logger) Option {
+	return func(defender *Defender) {
+		defender.logger = logger
+	}
+}
+
+// SetMetrics sets a callback receiving the Metrics of every request once RemoveXSS is done with it,
+// e.g. to feed Prometheus counters
+func SetMetrics(metrics func(m Metrics)) Option {
+	return func(defender *Defender) {
+		defender.metrics = metrics
+	}
+}
+
+// SetSkipURLFields sets fields holding URLs, which are checked with url.Parse instead of the policy:
+// relative, http, https and mailto URLs are kept verbatim, anything else, or a URL holding markup, is cleared.
+// Fields are named as with SetSkipFields.
+func SetSkipURLFields(fields ...string) Option {
+	return func(defender *Defender) {
+		defender.urlFields = fields
+	}
+}
+
+// SetDataURIFields sets fields holding images as data URIs, e.g. "avatar", which are checked instead of going
+// through the policy: base64 data URIs of PNG, JPEG, GIF, WebP or BMP images are kept verbatim, anything else is
+// cleared. Fields are named as with SetSkipFields.
+func SetDataURIFields(fields ...string) Option {
+	return func(defender *Defender) {
+		defender.dataURIFields = fields
+	}
+}
+
+// SetStripFields sets fields whose markup is removed rather than encoded, e.g. numbers shown as text: every element
+// is dropped, whatever the policy, and so are the characters the policy would escape, so "<b>123</b>" becomes "123".
+// Fields are named as with SetSkipFields.
+func SetStripFields(fields ...string) Option {
+	return func(defender *Defender) {
+		defender.stripFields = fields
+	}
+}
+
+// SetPreserveFormatting keeps sanitized JSON request bodies indented the way they were sent, with the same
+// indentation string, rather than compacting them. Streamed bodies are always compacted.
+func SetPreserveFormatting(preserve bool) Option {
+	return func(defender *Defender) {
+		defender.preserveFormatting = preserve
+	}
+}
+
+// SetSanitizePath makes RemoveXSS run each segment of the request path through the policy as well,
+// along with the path parameters gin extracted from it
+func SetSanitizePath(sanitize bool) Option {
+	return func(defender *Defender) {
+		defender.sanitizePath = sanitize
+	}
+}
+
+// SetMaxJSONDepth makes JSON bodies in which objects and arrays nest more than n levels deep fail, so that
+// pathological documents are refused before they are rebuilt. Any depth is accepted by default.
+func SetMaxJSONDepth(n int) Option {
+	return func(defender *Defender) {
+		defender.maxJSONDepth = n
+	}
+}
+
+// SetHandleXML makes RemoveXSS sanitize text/xml and application/xml bodies too, their text and attribute values.
+// Fields are named after the dotted path of element names, e.g. "order.note", or of element and attribute names.
+// Bodies the decoder can't read, e.g. declaring another encoding than UTF-8 or using HTML entities, are refused.
+func SetHandleXML(handle bool) Option {
+	return func(defender *Defender) {
+		defender.handleXML = handle
+	}
+}
+
+// SetOptOutHeader lets requests carrying a non-empty header name, e.g. "X-Skip-XSS: 1", bypass the middlewares
+// when they come from one of trustedAddrs, given as IP addresses or CIDR ranges. The header is ignored from
+// any other address.
+func SetOptOutHeader(name string, trustedAddrs ...string) Option {
+	return func(defender *Defender) {
+		defender.optOutHeader = name
+		defender.trustedAddrs = trustedAddrs
+	}
+}
+
+// SetSkipEmptyValues makes empty values of JSON, form and query fields, and of multipart parts, be written back as
+// they were sent, without running field transforms or the policy on them nor counting them in Metrics.
+func SetSkipEmptyValues(skip bool) Option {
+	return func(defender *Defender) {
+		defender.skipEmptyValues = skip
+	}
+}
+
+// SetSanitizeFileParts makes multipart file parts for which sanitize returns true run through the policy like
+// other parts, e.g. HTML or SVG snippets served inline later. File contents are left alone by default.
+func SetSanitizeFileParts(sanitize func(filename, contentType string) bool) Option {
+	return func(defender *Defender) {
+		defender.sanitizeFilePart = sanitize
+	}
+}
+
+// SetBodyMethods sets the methods whose request body is sanitized, POST, PUT, PATCH and DELETE by default
+func SetBodyMethods(methods ...string) Option {
+	return func(defender *Defender) {
+		defender.bodyMethods = methods
+	}
+}
+
+// SetQueryMethods sets the methods whose query string is sanitized, GET by default
+func SetQueryMethods(methods ...string) Option {
+	return func(defender *Defender) {
+		defender.queryMethods = methods
+	}
+}
+
+// SetMultipartJSONFields makes the multipart parts with the given names, e.g. "data", sanitized as JSON documents
+// rather than as text, so that their structure survives. Parts not holding valid JSON are sanitized as text.
+func SetMultipartJSONFields(fields ...string) Option {
+	return func(defender *Defender) {
+		defender.multipartJSONFields = fields
+	}
+}
+
+// SetAllowedURLSchemes adds schemes, e.g. "https" and "mailto", to the URL schemes the policy accepts in href and
+// src attributes, and makes it drop links it can't parse or whose scheme isn't accepted. The policy is changed in place.
+func SetAllowedURLSchemes(schemes ...string) Option {
+	return func(defender *Defender) {
+		defender.urlSchemes = schemes
+	}
+}
+
+// SetOnlySanitizeFields turns skip fields around: only the values of fields, named like skip fields, are sanitized
+// and everything else is passed verbatim. Configured headers and cookies are sanitized regardless.
+// It replaces the fields set with SetSkipFields.
+func SetOnlySanitizeFields(fields ...string) Option {
+	return func(defender *Defender) {
+		defender.onlyFields = fields
+		defender.skipFields = nil
+	}
+}
+
+// SetSniffContentType makes RemoveXSS look at the body of requests sent without Content-Type, some proxies drop it,
+// and sanitize it as JSON when it is a JSON document. Other bodies are left alone.
+func SetSniffContentType(sniff bool) Option {
+	return func(defender *Defender) {
+		defender.sniffContentType = sniff
+	}
+}
+
+// SetEntityEncoding chooses how sanitized values write the characters the policy escapes: EscapeEntities keeps
+// the entities, "a &lt; b", StripEntities removes the characters, "a  b". Markup allowed by the policy is kept.
+func SetEntityEncoding(encoding EntityEncoding) Option {
+	return func(defender *Defender) {
+		defender.entityEncoding = encoding
+	}
+}
+
+// SetDuplicateKeyPolicy chooses what becomes of the members of a JSON object sharing a key: RejectDuplicateKeys
+// fails the request, KeepFirstKey and KeepLastKey keep a single one, at the place of the first. By default every
+// member is kept. Bodies sanitized with SetStreamingJSON keep every member.
+func SetDuplicateKeyPolicy(duplicates DuplicateKeyPolicy) Option {
+	return func(defender *Defender) {
+		defender.duplicateKeys = duplicates
+	}
+}
+
+// SetUnicodeNormalization normalizes values to form, e.g. norm.NFKC, before they go through the policy, so that
+// look-alike characters such as fullwidth brackets are sanitized as the markup they stand for. Values are left
+// as they are by default. Normalized values count as changed.
+func SetUnicodeNormalization(form norm.Form) Option {
+	return func(defender *Defender) {
+		defender.normalize = true
+		defender.normalization = form
+	}
+}
+
+// SetResponsePolicy sets the policy FilterXSS sanitizes response bodies with instead of the policy of the Defender,
+// which RemoveXSS keeps using. With IdentityPolicy responses are sent as they are, without being decoded.
+func SetResponsePolicy(policy *bluemonday.Policy) Option {
+	return func(defender *Defender) {
+		defender.responsePolicy = policy
+	}
+}
+
+// SetResponseContentTypes sets the media types of the responses FilterXSS sanitizes, e.g. "application/hal+json" and
+// "text/html", instead of JSON ones. JSON types are sanitized value by value, others as a whole document.
+func SetResponseContentTypes(types ...string) Option {
+	return func(defender *Defender) {
+		defender.responseTypes = types
+	}
+}
+
+// SetMaxQueryParams makes GET requests with more than n query parameters fail before any is sanitized.
+// There is no limit by default.
+func SetMaxQueryParams(n int) Option {
+	return func(defender *Defender) {
+		defender.maxQueryParams = n
+	}
+}
+
+// SetQueryAllowlist restricts the sanitization of query strings to the parameters named, e.g. "q" and "search",
+// others are left alone. Every parameter but skip fields is sanitized by default. Form bodies aren't affected.
+func SetQueryAllowlist(params ...string) Option {
+	return func(defender *Defender) {
+		defender.queryAllowlist = params
+	}
+}
+
+// SetFormatIndicator lets JSON objects say which of their members hold HTML: a member with a sibling named after it
+// followed by suffix, e.g. "body" and "body_format" for "_format", is only sanitized when the sibling is htmlValue.
+// Members without such a sibling are sanitized as usual. Streamed bodies ignore indicators.
+func SetFormatIndicator(suffix string, htmlValue string) Option {
+	return func(defender *Defender) {
+		defender.formatSuffix = suffix
+		defender.formatHTML = htmlValue
+	}
+}
+
+// SetMaxPartBytes makes multipart bodies with a part larger than n bytes fail, files included.
+// Parts of any size are accepted by default.
+func SetMaxPartBytes(n int64) Option {
+	return func(defender *Defender) {
+		defender.maxPartBytes = n
+	}
+}
+
+// SetMaxMultipartParts makes multipart bodies with more than n parts fail, 1000 by default. There is no limit
+// when n isn't positive.
+func SetMaxMultipartParts(n int) Option {
+	return func(defender *Defender) {
+		defender.maxMultipartParts = n
+	}
+}
+
+// SetPolicyConfigurer adds configure to the functions run on the policy once the Defender is built, e.g. to allow
+// comments or a few elements without writing a whole policy. The policy is changed in place.
+func SetPolicyConfigurer(configure func(*bluemonday.Policy)) Option {
+	return func(defender *Defender) {
+		defender.configurers = append(defender.configurers, configure)
+	}
+}
+
+// SetSkipFieldsCaseInsensitive makes skip fields match field names and paths whatever their case, e.g. "password"
+// skipping "Password" and "PASSWORD" too. Matching is exact by default.
+func SetSkipFieldsCaseInsensitive(fold bool) Option {
+	return func(defender *Defender) {
+		defender.skipFieldsFold = fold
+	}
+}
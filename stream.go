@@ -0,0 +1,131 @@
+package xss
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// streamFrame is an object or array being copied by streamJson
+type streamFrame struct {
+	object  bool
+	keyNext bool // the next string token is a key of the object
+	key     string
+	count   int
+	path    string
+	policy  *bluemonday.Policy
+	skip    bool
+}
+
+// handleJsonStream sanitizes a JSON body token by token instead of decoding it into a tree first.
+// The body is consumed as it is read, so malformed JSON fails the request.
+func (p *Defender) handleJsonStream(req *http.Request) error {
+	var buff bytes.Buffer
+	if err := p.streamJson(&buff, req.Body); err != nil {
+		return err
+	}
+
+	setBody(req, buff.Bytes())
+	return nil
+}
+
+// streamJson copies the JSON values read from src to dst, sanitizing string values on the way. A panic while
+// sanitizing one is returned as an *XSSError naming the field, as jsonToStringMap does.
+func (p *Defender) streamJson(dst io.Writer, src io.Reader) (err error) {
+	defer recoverJson(&err)
+	dec := json.NewDecoder(src)
+	dec.UseNumber()
+	w := bufio.NewWriter(dst)
+
+	var stack []*streamFrame
+	// begin writes what separates a value from the previous one and returns where the value sits
+	begin := func() (string, *bluemonday.Policy, bool) {
+		if len(stack) == 0 {
+			return "", p.policy, false
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			top.keyNext = true
+			fieldPath := joinPath(top.path, top.key)
+			return fieldPath, p.fieldPolicy(fieldPath, top.key, top.policy), top.skip || p.isSkipField(fieldPath, top.key)
+		}
+		if top.count > 0 {
+			w.WriteByte(',')
+		}
+		top.count++
+		return top.path, top.policy, top.skip
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF && len(stack) > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				if p.maxJSONDepth > 0 && len(stack) >= p.maxJSONDepth {
+					return errTooDeep
+				}
+				path, policy, skip := begin()
+				stack = append(stack, &streamFrame{object: t == '{', keyNext: t == '{', path: path, policy: policy, skip: skip})
+			default:
+				stack = stack[:len(stack)-1]
+			}
+			w.WriteString(t.String())
+		case string:
+			if len(stack) > 0 && stack[len(stack)-1].keyNext {
+				top := stack[len(stack)-1]
+				if top.count > 0 {
+					w.WriteByte(',')
+				}
+				top.count++
+				top.keyNext = false
+				top.key = t
+				w.WriteString(quoteJson(t))
+				w.WriteByte(':')
+				continue
+			}
+			path, policy, skip := begin()
+			if skip {
+				w.WriteString(quoteJson(t))
+			} else {
+				w.WriteString(quoteJson(p.streamValue(path, t, policy)))
+			}
+		case json.Number:
+			begin()
+			w.WriteString(t.String())
+		case bool:
+			begin()
+			w.WriteString(strconv.FormatBool(t))
+		case nil:
+			begin()
+			w.WriteString("null")
+		}
+	}
+
+	return w.Flush()
+}
+
+// streamValue sanitizes a string value found by streamJson at path, a panic on the way carries path up
+func (p *Defender) streamValue(path, value string, policy *bluemonday.Policy) string {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(jsonPanic{path: path, value: r})
+		}
+	}()
+	return p.sanitizeValue(path, value, policy)
+}
@@ -0,0 +1,143 @@
+package xss
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// SanitizeStruct sanitizes in place the strings v points to, e.g. a struct filled by c.ShouldBind. Exported string
+// fields are sanitized, as are strings held in nested structs, pointers, slices, arrays, maps and interfaces.
+// Fields are named after their json tag, or their Go name, for skip fields and field policies. Fields tagged
+// `xss:"skip"` are left alone, those tagged with the name of a policy, e.g. `xss:"ugc"`, are sanitized with it,
+// see SetTagPolicy.
+func (p *Defender) SanitizeStruct(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errNotPointer
+	}
+	return p.sanitizeReflect(rv, "", "", p.policy, map[uintptr]bool{})
+}
+
+// sanitizeReflect sanitizes the strings held by v, found at the dotted path and named key. seen holds the pointers
+// followed already, so that cycles end.
+func (p *Defender) sanitizeReflect(v reflect.Value, path, key string, policy *bluemonday.Policy, seen map[uintptr]bool) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || seen[v.Pointer()] {
+			return nil
+		}
+		seen[v.Pointer()] = true
+		return p.sanitizeReflect(v.Elem(), path, key, policy, seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		elem := v.Elem()
+		if elem.Kind() == reflect.Ptr {
+			return p.sanitizeReflect(elem, path, key, policy, seen)
+		}
+		// values held by an interface can't be set, sanitize a copy and put it back
+		cp := reflect.New(elem.Type()).Elem()
+		cp.Set(elem)
+		if err := p.sanitizeReflect(cp, path, key, policy, seen); err != nil {
+			return err
+		}
+		if v.CanSet() {
+			v.Set(cp)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("xss")
+			if field.PkgPath != "" || tag == "skip" {
+				continue
+			}
+			name := fieldName(field)
+			fieldPath := path
+			// embedded structs share the path of their parent, like encoding/json flattens them
+			if !field.Anonymous || field.Tag.Get("json") != "" {
+				fieldPath = joinPath(path, name)
+			}
+			if p.isSkipField(fieldPath, name) {
+				continue
+			}
+			fieldPolicy := p.fieldPolicy(fieldPath, name, policy)
+			if tag != "" {
+				var ok bool
+				if fieldPolicy, ok = p.tagPolicy(tag); !ok {
+					return &XSSError{Phase: "struct", Field: fieldPath, Err: fmt.Errorf("unknown policy %q", tag)}
+				}
+			}
+			if err := p.sanitizeReflect(v.Field(i), fieldPath, name, fieldPolicy, seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := p.sanitizeReflect(v.Index(i), path, key, policy, seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			// keys of other types don't name anything
+			name, fieldPath := key, path
+			if iter.Key().Kind() == reflect.String {
+				name = iter.Key().String()
+				fieldPath = joinPath(path, name)
+			}
+			if p.isSkipField(fieldPath, name) {
+				continue
+			}
+			// map values can't be set either
+			cp := reflect.New(iter.Value().Type()).Elem()
+			cp.Set(iter.Value())
+			if err := p.sanitizeReflect(cp, fieldPath, name, p.fieldPolicy(fieldPath, name, policy), seen); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), cp)
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(p.sanitizeValue(path, v.String(), policy))
+		}
+	}
+	return nil
+}
+
+// tagPolicy returns the policy an xss struct tag names, one registered with SetTagPolicy or a built-in one
+func (p *Defender) tagPolicy(name string) (*bluemonday.Policy, bool) {
+	if policy, ok := p.tagPolicies[name]; ok {
+		return policy, true
+	}
+	builtinOnce.Do(func() {
+		builtinPolicies = map[string]*bluemonday.Policy{
+			"strict": bluemonday.StrictPolicy(),
+			"ugc":    bluemonday.UGCPolicy(),
+			"none":   identityPolicy,
+		}
+	})
+	policy, ok := builtinPolicies[name]
+	return policy, ok
+}
+
+// builtinPolicies are the policies struct tags name by default, built once they are needed and never changed
+var (
+	builtinOnce     sync.Once
+	builtinPolicies map[string]*bluemonday.Policy
+)
+
+// fieldName is the name of field in a JSON document, that of its json tag or its Go name
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
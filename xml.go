@@ -0,0 +1,117 @@
+package xss
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// handleXml sanitizes the character data and attribute values of an XML body, element structure, comments and
+// processing instructions are kept. Text within an element is named after the dotted path of element names leading
+// to it, an attribute after the path of its element followed by its own name.
+func (p *Defender) handleXml(req *http.Request) (err error) {
+	defer wrapError(&err, "xml")
+	if req.Body == nil {
+		return nil
+	}
+	p.limitBody(req)
+
+	var raw bytes.Buffer
+	if _, err := raw.ReadFrom(req.Body); err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	if err := p.rewriteXml(&buff, bytes.NewReader(raw.Bytes())); err != nil {
+		// unlike malformed JSON, XML the decoder can't read fails the request: lenient parsers, with a charset
+		// reader or HTML entities, would read what went unsanitized
+		return err
+	}
+
+	setBody(req, buff.Bytes())
+	return nil
+}
+
+// rewriteXml copies the XML document read from src to buff, sanitizing text and attribute values on the way
+func (p *Defender) rewriteXml(buff *bytes.Buffer, src io.Reader) error {
+	dec := xml.NewDecoder(src)
+	// namespace prefixes are written back as they were sent
+	var stack []xmlFrame
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].path
+			}
+			path := joinPath(parent, t.Name.Local)
+			stack = append(stack, xmlFrame{path: path, key: t.Name.Local})
+
+			buff.WriteString("<" + xmlName(t.Name))
+			for _, attr := range t.Attr {
+				attrPath := joinPath(path, attr.Name.Local)
+				value := attr.Value
+				if !p.isSkipField(attrPath, attr.Name.Local) {
+					value = p.sanitizeValue(attrPath, value, p.fieldPolicy(attrPath, attr.Name.Local, p.policy))
+				}
+				buff.WriteString(" " + xmlName(attr.Name) + `="` + xmlAttrEscaper.Replace(value) + `"`)
+			}
+			buff.WriteByte('>')
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			buff.WriteString("</" + xmlName(t.Name) + ">")
+		case xml.CharData:
+			value := string(t)
+			if len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if !p.isSkipField(top.path, top.key) {
+					value = p.sanitizeValue(top.path, value, p.fieldPolicy(top.path, top.key, p.policy))
+				}
+			}
+			buff.WriteString(xmlTextEscaper.Replace(value))
+		case xml.Comment:
+			buff.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			buff.WriteString("<?" + t.Target)
+			if len(t.Inst) > 0 {
+				buff.WriteString(" " + string(t.Inst))
+			}
+			buff.WriteString("?>")
+		case xml.Directive:
+			buff.WriteString("<!" + string(t) + ">")
+		}
+	}
+	return nil
+}
+
+// xmlFrame is an element being copied by rewriteXml
+type xmlFrame struct {
+	path string
+	key  string
+}
+
+// escapers of text and attribute values, whitespace is left alone to keep the document layout
+var (
+	xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+// xmlName returns n with its namespace prefix, if any
+func xmlName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
@@ -2,40 +2,354 @@ package xss
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/microcosm-cc/bluemonday"
+	"golang.org/x/text/unicode/norm"
 	"io"
 	"io/ioutil"
+	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 type Json map[string]interface{}
 
+// context keys marking the requests a Defender's middlewares went through already
+const (
+	removedKey  = "xss.removed"
+	filteredKey = "xss.filtered"
+)
+
+// SummaryContextKey is the gin context key under which RemoveXSS stores the Summary of the request
+const SummaryContextKey = "xss.summary"
+
+// SkipContextKey is the gin context key an earlier middleware sets to true, with c.Set, for RemoveXSS and
+// FilterXSS to leave the request alone
+const SkipContextKey = "xss.skip"
+
+// BodyHandler sanitizes in place the body of a request whose content type it was registered for
+type BodyHandler func(defender *Defender, req *http.Request) error
+
 type Defender struct {
-	skipFields []string
-	policy     *bluemonday.Policy
+	skipFields        []string
+	skipFieldPatterns []*regexp.Regexp
+	skipFieldsFold    bool
+	skipPaths         []string
+	optOutHeader      string
+	trustedAddrs      []string
+	urlFields         []string
+	dataURIFields     []string
+	stripFields       []string
+	onlyFields        []string
+	formatSuffix      string
+	formatHTML        string
+	policy            *bluemonday.Policy
+	urlSchemes        []string
+	responsePolicy    *bluemonday.Policy
+	responseTypes     []string
+	configurers       []func(*bluemonday.Policy)
+	fieldPolicies     map[string]*bluemonday.Policy
+	tagPolicies       map[string]*bluemonday.Policy
+	fieldTransforms   map[string]func(string) string
+	contentHandlers   map[string]BodyHandler
+	errorHandler      func(*gin.Context, error)
+
+	sanitizeHeaderNames  []string
+	responseHeaderNames  []string
+	sanitizeCookieNames  []string
+	maxBodyBytes         int64
+	streamingJSON        bool
+	preserveFormatting   bool
+	sanitizePath         bool
+	maxJSONDepth         int
+	maxQueryParams       int
+	queryAllowlist       []string
+	maxPartBytes         int64
+	maxMultipartParts    int
+	handleXML            bool
+	sniffContentType     bool
+	entityEncoding       EntityEncoding
+	normalize            bool
+	normalization        norm.Form
+	duplicateKeys        DuplicateKeyPolicy
+	sanitizeFilePart     func(filename, contentType string) bool
+	multipartJSONFields  []string
+	skipEmptyValues      bool
+	bodyMethods          []string
+	queryMethods         []string
+	reporter             func(field, before, after string)
+	rejectOnModification bool
+	failOpen             bool
+	rejectStatus         int
+	filterErrorResponses bool
+	responseBufferLimit  int64
+	logger               Logger
+	metrics              func(Metrics)
+
+	// pass is only set on the copy of the Defender sanitizing a single request
+	pass *pass
+}
+
+// pass gathers what happened while sanitizing a single request
+type pass struct {
+	modified []string
+	metrics  Metrics
+}
+
+// Summary tells handlers what RemoveXSS did to a request, read it with c.Get(SummaryContextKey)
+type Summary struct {
+	// Modified lists the fields sanitization altered, in the order they were found
+	Modified []string
+	Metrics  Metrics
+}
+
+// Metrics counts what a single request went through, see SetMetrics
+type Metrics struct {
+	// FieldsInspected and FieldsModified count the values run through a policy and those it altered
+	FieldsInspected int
+	FieldsModified  int
+	// BytesIn and BytesOut are the total lengths of the inspected values before and after sanitization
+	BytesIn  int
+	BytesOut int
+}
+
+// DuplicateKeyPolicy is what becomes of the members of a JSON object sharing a key, see SetDuplicateKeyPolicy
+type DuplicateKeyPolicy string
+
+const (
+	// KeepAllKeys writes every member back, each sanitized, it is the default
+	KeepAllKeys DuplicateKeyPolicy = ""
+	// RejectDuplicateKeys fails requests and responses with an object holding a key twice
+	RejectDuplicateKeys DuplicateKeyPolicy = "reject"
+	// KeepFirstKey keeps the first of the members sharing a key
+	KeepFirstKey DuplicateKeyPolicy = "first"
+	// KeepLastKey keeps the last of the members sharing a key, the one encoding/json decodes
+	KeepLastKey DuplicateKeyPolicy = "last"
+)
+
+// EntityEncoding is how the characters a policy escapes are written, see SetEntityEncoding
+type EntityEncoding string
+
+const (
+	// EscapeEntities keeps the entities written by the policy, e.g. "&lt;", it is the default
+	EscapeEntities EntityEncoding = "escape"
+	// StripEntities removes the characters the policy escapes instead, '<', '>', '&', '"' and '\''
+	StripEntities EntityEncoding = "strip"
+)
+
+// stripPolicy removes every element from strip fields, whatever the policy of the Defender, see SetStripFields
+var stripPolicy = bluemonday.StrictPolicy()
+
+// entityStripper removes the entities bluemonday escapes text with
+var entityStripper = strings.NewReplacer("&lt;", "", "&gt;", "", "&amp;", "", "&#34;", "", "&#39;", "")
+
+// ModifiedError is returned when SetRejectOnModification is set and sanitization alters a field
+type ModifiedError struct {
+	Field string
+}
+
+func (e *ModifiedError) Error() string {
+	return fmt.Sprintf("field %q contains disallowed markup", e.Field)
+}
+
+// XSSError is returned when a request or response body can't be sanitized, Err being the cause
+type XSSError struct {
+	// Phase is what was being sanitized: "json", "ndjson", "form", "multipart", "query", "xml", "body" while decompressing
+	// a request body, "response", or "struct" for SanitizeStruct
+	Phase string
+	// Field is the field that failed, when the failure is about a single one
+	Field string
+	Err   error
+}
+
+func (e *XSSError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("xss %s field %q: %v", e.Phase, e.Field, e.Err)
+	}
+	return fmt.Sprintf("xss %s: %v", e.Phase, e.Err)
+}
+
+func (e *XSSError) Unwrap() error {
+	return e.Err
+}
+
+// wrapError turns *err, if any, into an *XSSError of phase unless it is one already
+func wrapError(err *error, phase string) {
+	var xssErr *XSSError
+	if *err != nil && !errors.As(*err, &xssErr) {
+		*err = &XSSError{Phase: phase, Err: *err}
+	}
 }
 
 func DefaultDefender(options ...Option) *Defender {
-	options = append(options, SetSkipFields("password"))
+	// "password" is skipped unless the caller configures its own skip fields
+	options = append([]Option{SetSkipFields("password")}, options...)
 	return NewDefender(bluemonday.StrictPolicy(), options...)
 }
 
 func NewDefender(policy *bluemonday.Policy, options ...Option) *Defender {
-	res := &Defender{policy: policy}
+	res := &Defender{
+		policy:            policy,
+		rejectStatus:      http.StatusBadRequest,
+		logger:            nopLogger{},
+		maxMultipartParts: 1000, // enough for any form, too few to keep a server busy
+		bodyMethods:       []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		queryMethods:      []string{http.MethodGet},
+	}
 	for _, option := range options {
 		option(res)
 	}
+	res.configurePolicy()
 	return res
 }
 
+// Clone returns a copy of p with options applied on top of its configuration, e.g. to add a skip field for a
+// single route. p is left unchanged. Policies are shared, so URL schemes and configurers need a policy of their own:
+// Clone panics when options change them without setting a policy.
+func (p *Defender) Clone(options ...Option) *Defender {
+	res := *p
+	res.pass = nil
+	res.skipFields = append([]string(nil), p.skipFields...)
+	res.skipFieldPatterns = append([]*regexp.Regexp(nil), p.skipFieldPatterns...)
+	res.skipPaths = append([]string(nil), p.skipPaths...)
+	res.trustedAddrs = append([]string(nil), p.trustedAddrs...)
+	res.urlFields = append([]string(nil), p.urlFields...)
+	res.dataURIFields = append([]string(nil), p.dataURIFields...)
+	res.stripFields = append([]string(nil), p.stripFields...)
+	res.onlyFields = append([]string(nil), p.onlyFields...)
+	res.urlSchemes = append([]string(nil), p.urlSchemes...)
+	res.responseTypes = append([]string(nil), p.responseTypes...)
+	res.configurers = append(([]func(*bluemonday.Policy))(nil), p.configurers...)
+	res.sanitizeHeaderNames = append([]string(nil), p.sanitizeHeaderNames...)
+	res.responseHeaderNames = append([]string(nil), p.responseHeaderNames...)
+	res.sanitizeCookieNames = append([]string(nil), p.sanitizeCookieNames...)
+	res.multipartJSONFields = append([]string(nil), p.multipartJSONFields...)
+	res.bodyMethods = append([]string(nil), p.bodyMethods...)
+	res.queryMethods = append([]string(nil), p.queryMethods...)
+	res.queryAllowlist = append([]string(nil), p.queryAllowlist...)
+	if p.fieldPolicies != nil {
+		res.fieldPolicies = make(map[string]*bluemonday.Policy, len(p.fieldPolicies))
+		for k, v := range p.fieldPolicies {
+			res.fieldPolicies[k] = v
+		}
+	}
+	if p.tagPolicies != nil {
+		res.tagPolicies = make(map[string]*bluemonday.Policy, len(p.tagPolicies))
+		for k, v := range p.tagPolicies {
+			res.tagPolicies[k] = v
+		}
+	}
+	if p.fieldTransforms != nil {
+		res.fieldTransforms = make(map[string]func(string) string, len(p.fieldTransforms))
+		for k, v := range p.fieldTransforms {
+			res.fieldTransforms[k] = v
+		}
+	}
+	if p.contentHandlers != nil {
+		res.contentHandlers = make(map[string]BodyHandler, len(p.contentHandlers))
+		for k, v := range p.contentHandlers {
+			res.contentHandlers[k] = v
+		}
+	}
+
+	for _, option := range options {
+		option(&res)
+	}
+	if res.policy != p.policy {
+		res.configurePolicy()
+	} else if !sameStrings(res.urlSchemes, p.urlSchemes) || len(res.configurers) != len(p.configurers) {
+		panic("xss: Clone options change the URL schemes or configurers of the policy it shares, set a policy too")
+	}
+	return &res
+}
+
+// sameStrings reports whether a and b hold the same strings in the same order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy returns the policy p sanitizes requests with, IdentityPolicy when it keeps everything. Changes made to it,
+// e.g. with AllowElements, apply to p and must be made before it serves requests.
+func (p *Defender) Policy() *bluemonday.Policy {
+	return p.policy
+}
+
+// configurePolicy applies the URL schemes and configurers to the policy, whichever was set last
+func (p *Defender) configurePolicy() {
+	if p.policy == identityPolicy {
+		return
+	}
+	if len(p.urlSchemes) > 0 {
+		p.policy.AllowURLSchemes(p.urlSchemes...)
+	}
+	for _, configure := range p.configurers {
+		configure(p.policy)
+	}
+}
+
+// NewDefenderFromName is NewDefender with the policy named name, e.g. in a configuration file:
+// "strict" for bluemonday.StrictPolicy, "ugc" for bluemonday.UGCPolicy or "none" for IdentityPolicy
+func NewDefenderFromName(name string, options ...Option) (*Defender, error) {
+	var policy *bluemonday.Policy
+	switch strings.ToLower(name) {
+	case "strict":
+		policy = bluemonday.StrictPolicy()
+	case "ugc":
+		policy = bluemonday.UGCPolicy()
+	case "none":
+		policy = IdentityPolicy()
+	default:
+		return nil, fmt.Errorf("unknown policy %q", name)
+	}
+	return NewDefender(policy, options...), nil
+}
+
+// identityPolicy stands for no policy at all, values sanitized with it are kept as they are
+var identityPolicy = bluemonday.NewPolicy()
+
+// IdentityPolicy returns the policy keeping every value as it is, e.g. for fields encoded elsewhere
+func IdentityPolicy() *bluemonday.Policy {
+	return identityPolicy
+}
+
+// sanitizeWith returns value sanitized with policy
+func sanitizeWith(policy *bluemonday.Policy, value string) string {
+	// without markup, entities, quotes or carriage returns values come out of any policy as they went in,
+	// which is the common case and spares parsing them
+	if policy == identityPolicy || !strings.ContainsAny(value, htmlSignificant) {
+		return value
+	}
+	return policy.Sanitize(value)
+}
+
+// htmlSignificant are the characters bluemonday may rewrite text for
+const htmlSignificant = "<>&\"'\r"
+
+// RemoveXSS sanitizes incoming requests, once per request even when registered twice with the same Defender,
+// e.g. globally and on a group. The shipped policies are idempotent: values sanitized by RemoveXSS and then
+// by FilterXSS are escaped once, "a & b" becoming "a &amp; b" and staying so.
 func (p *Defender) RemoveXSS() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		p.removeXSS(ctx)
@@ -44,41 +358,243 @@ func (p *Defender) RemoveXSS() gin.HandlerFunc {
 }
 
 func (p *Defender) removeXSS(ctx *gin.Context) {
+	if p.isSkipRequest(ctx.Request) || ctx.GetBool(SkipContextKey) {
+		ctx.Next()
+		return
+	}
+	if done, ok := ctx.Get(removedKey); ok && done == p {
+		ctx.Next()
+		return
+	}
+	ctx.Set(removedKey, p)
+
 	err := p.XssRemove(ctx)
 	if err != nil {
+		if p.errorHandler != nil {
+			p.errorHandler(ctx, err)
+		} else {
+			p.abortWithError(ctx, err)
+		}
 		ctx.Abort()
 		return
 	}
 	ctx.Next()
 }
 
+// abortWithError is the default error handler of RemoveXSS
+func (p *Defender) abortWithError(ctx *gin.Context, err error) {
+	ctx.AbortWithStatusJSON(p.errorStatus(err), gin.H{"msg": err.Error()})
+}
+
+// isSkipRequest reports whether req bypasses the middlewares, because of its path or because it opted out
+func (p *Defender) isSkipRequest(req *http.Request) bool {
+	return p.isSkipPath(req.URL.Path) || p.isOptedOut(req)
+}
+
+// isOptedOut reports whether req carries the opt-out header and comes from a trusted address, see SetOptOutHeader
+func (p *Defender) isOptedOut(req *http.Request) bool {
+	if p.optOutHeader == "" || req.Header.Get(p.optOutHeader) == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, addr := range p.trustedAddrs {
+		if _, network, err := net.ParseCIDR(addr); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if trusted := net.ParseIP(addr); trusted != nil && trusted.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSkipPath reports whether requests to path bypass the middlewares
+func (p *Defender) isSkipPath(path string) bool {
+	for _, skip := range p.skipPaths {
+		if strings.HasSuffix(skip, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(skip, "*")) {
+				return true
+			}
+		} else if path == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// errorStatus is the status a request failing with err is answered with by default
+func (p *Defender) errorStatus(err error) int {
+	var modified *ModifiedError
+	if errors.As(err, &modified) {
+		return p.rejectStatus
+	}
+	return http.StatusBadRequest
+}
+
 func (p *Defender) XssRemove(c *gin.Context) error {
+	summary, err := p.sanitizeRequest(c.Request)
+	c.Set(SummaryContextKey, summary)
+	if err != nil {
+		return err
+	}
+	// bodies are read once, keep the sanitized one around for SanitizedBody and ShouldBindBodyWith
+	if body, ok := c.Request.Body.(*sanitizedBody); ok {
+		c.Set(gin.BodyBytesKey, body.data)
+	}
+	// gin has routed the request already, its path parameters hold the segments as they were sent
+	// the same way as the segments of URL.Path, counted there already
+	if p.sanitizePath && p.reporter == nil {
+		quiet := p.quiet()
+		for i, param := range c.Params {
+			c.Params[i].Value = quiet.applyPolicy("path", param.Value, p.policy)
+		}
+	}
+	return nil
+}
+
+// sanitizeRequest rewrites the query or body of req, this is where the gin and net/http middlewares meet
+func (p *Defender) sanitizeRequest(req *http.Request) (Summary, error) {
+	// work on a copy carrying the state of this request only
+	d := *p
+	d.pass = &pass{}
+
+	restore := func() {}
+	if d.failOpen {
+		restore = keepBody(req)
+	}
+
+	var err error
+	if d.reporter != nil {
+		err = d.reportRequest(req)
+	} else {
+		err = d.rewriteRequest(req)
+	}
+	if d.metrics != nil {
+		d.metrics(d.pass.metrics)
+	}
+	summary := Summary{Modified: d.pass.modified, Metrics: d.pass.metrics}
+	if err != nil && d.failOpen {
+		restore()
+		d.logger.Infof("xss: %s %s could not be sanitized, body passed on as received: %v", req.Method, req.URL.Path, err)
+		return summary, nil
+	}
+	if err != nil {
+		d.logger.Infof("xss: %s %s could not be sanitized: %v", req.Method, req.URL.Path, err)
+		return summary, err
+	}
+
+	if len(d.pass.modified) > 0 {
+		d.logger.Debugf("xss: %s %s, fields changed: %s", req.Method, req.URL.Path, strings.Join(d.pass.modified, ", "))
+	}
+	if d.rejectOnModification && len(d.pass.modified) > 0 {
+		d.logger.Infof("xss: %s %s rejected, field %q contains disallowed markup", req.Method, req.URL.Path, d.pass.modified[0])
+		return summary, &ModifiedError{Field: d.pass.modified[0]}
+	}
+	return summary, nil
+}
+
+// keepBody makes req keep a copy of what is read from its body, the func returned puts the body back as it was
+// received, along with its length and encoding
+func keepBody(req *http.Request) func() {
+	body := req.Body
+	if body == nil {
+		return func() {}
+	}
+	contentLength := req.ContentLength
+	length, encoding := req.Header.Values("Content-Length"), req.Header.Values("Content-Encoding")
+
+	var read bytes.Buffer
+	req.Body = ioutil.NopCloser(io.TeeReader(body, &read))
+	return func() {
+		// what wasn't read yet follows what was
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(read.Bytes()), body), body}
+		req.ContentLength = contentLength
+		setHeaderValues(req.Header, "Content-Length", length)
+		setHeaderValues(req.Header, "Content-Encoding", encoding)
+	}
+}
+
+// setHeaderValues sets the values of the header key, removing it when there are none
+func setHeaderValues(header http.Header, key string, values []string) {
+	header.Del(key)
+	for _, value := range values {
+		header.Add(key, value)
+	}
+}
+
+// reportRequest sanitizes req only to report what would change, then puts everything back as it was
+func (p *Defender) reportRequest(req *http.Request) error {
+	header := req.Header.Clone()
+	rawQuery := req.URL.RawQuery
+	contentLength := req.ContentLength
+	form, postForm := req.Form, req.PostForm
+	path, rawPath := req.URL.Path, req.URL.RawPath
+
+	// only bodies rewriteRequest reads are kept, others are left to the handler as they would be when enforcing
+	var raw []byte
+	keep := req.Body != nil && hasMethod(p.bodyMethods, req.Method) && p.bodyHandler(req.Header.Get("Content-Type")) != nil
+	if keep {
+		p.limitBody(req)
+		var err error
+		if raw, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	}
+
+	err := p.rewriteRequest(req)
+
+	req.Header = header
+	req.URL.RawQuery = rawQuery
+	req.ContentLength = contentLength
+	req.Form, req.PostForm = form, postForm
+	req.URL.Path, req.URL.RawPath = path, rawPath
+	if keep {
+		req.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	}
+	return err
+}
+
+func (p *Defender) rewriteRequest(req *http.Request) error {
 	// https://golang.org/pkg/net/http/#Request
-	ReqMethod := c.Request.Method
+	ReqMethod := req.Method
 
-	reqContentType := c.Request.Header.Get("Content-Type")
-	reqContentLen := c.Request.Header.Get("Content-Length")
-	rclen, _ := strconv.Atoi(reqContentLen)
+	p.sanitizeHeaders(req)
+	p.sanitizeCookies(req)
+	if p.sanitizePath {
+		p.sanitizeURLPath(req)
+	}
+
+	reqContentType := req.Header.Get("Content-Type")
 
 	// https://golang.org/src/net/http/request.go
 
-	switch ReqMethod {
-	case http.MethodPost, http.MethodPut, http.MethodPatch:
-		if rclen > 1 && reqContentType == "application/json" {
-			if err := p.HandleJson(c); err != nil {
-				return err
-			}
-		} else if reqContentType == "application/x-www-form-urlencoded" {
-			if err := p.HandleXFormEncoded(c); err != nil {
-				return err
-			}
-		} else if strings.Contains(reqContentType, "multipart/form-data") {
-			if err := p.HandleMultiPartFormData(c, reqContentType); err != nil {
-				return err
-			}
+	switch {
+	case hasMethod(p.bodyMethods, ReqMethod):
+		handle := p.bodyHandler(reqContentType)
+		if handle == nil {
+			// bodies of other types are passed on as they are, compressed or not
+			return nil
+		}
+		if err := p.decodeBody(req); err != nil {
+			return err
+		}
+		if err := handle(req); err != nil {
+			return err
 		}
-	case http.MethodGet:
-		if err := p.HandleGETRequest(c); err != nil {
+	case hasMethod(p.queryMethods, ReqMethod):
+		if err := p.handleQuery(req); err != nil {
 			return err
 		}
 	default:
@@ -87,264 +603,1003 @@ func (p *Defender) XssRemove(c *gin.Context) error {
 	return nil
 }
 
-func (p *Defender) HandleJson(c *gin.Context) error {
-	jsonBod, err := decodeJson(c.Request.Body)
+// bodyHandler returns what sanitizes a request body of contentType, nil for bodies that are not sanitized
+func (p *Defender) bodyHandler(contentType string) func(*http.Request) error {
+	mt := mediaType(contentType)
+	if handler, ok := p.contentHandlers[mt]; ok {
+		return func(req *http.Request) error { return handler(p, req) }
+	}
+	switch {
+	case isJsonMediaType(contentType):
+		return p.handleJson
+	case mt == "application/x-ndjson":
+		return p.handleNdjson
+	case mt == "application/x-www-form-urlencoded":
+		return p.handleXFormEncoded
+	case strings.HasPrefix(mt, "multipart/"):
+		return func(req *http.Request) error { return p.handleMultiPartFormData(req, contentType) }
+	case p.handleXML && isXmlMediaType(contentType):
+		return p.handleXml
+	case p.sniffContentType && contentType == "":
+		return p.sniffJson
+	}
+	return nil
+}
+
+// hasMethod reports whether method is one of methods
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeHeaders runs the values of the configured headers through the policy, other headers are left alone
+func (p *Defender) sanitizeHeaders(req *http.Request) {
+	for _, name := range p.sanitizeHeaderNames {
+		values := req.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		req.Header.Del(name)
+		for _, value := range values {
+			req.Header.Add(name, p.applyPolicy(name, value, p.policy))
+		}
+	}
+}
+
+// sanitizeURLPath runs each segment of the request path through the policy, altered segments are escaped again
+func (p *Defender) sanitizeURLPath(req *http.Request) {
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	changed := false
+	for i, segment := range segments {
+		value, err := url.PathUnescape(segment)
+		if err != nil {
+			continue
+		}
+		if clean := p.applyPolicy("path", value, p.policy); clean != value {
+			segments[i] = url.PathEscape(clean)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	rawPath := strings.Join(segments, "/")
+	path, err := url.PathUnescape(rawPath)
 	if err != nil {
+		return
+	}
+	req.URL.Path = path
+	req.URL.RawPath = rawPath
+}
+
+// sanitizeCookies runs the values of the configured cookies through the policy and rewrites the Cookie header,
+// other cookies are kept verbatim
+func (p *Defender) sanitizeCookies(req *http.Request) {
+	if len(p.sanitizeCookieNames) == 0 {
+		return
+	}
+	lines := req.Header.Values("Cookie")
+	for i, line := range lines {
+		pairs := strings.Split(line, ";")
+		for j, pair := range pairs {
+			name, value := strings.TrimSpace(pair), ""
+			if eq := strings.Index(name, "="); eq >= 0 {
+				name, value = name[:eq], name[eq+1:]
+			}
+			for _, cookie := range p.sanitizeCookieNames {
+				if name == cookie {
+					pairs[j] = name + "=" + cookieValue(p.applyPolicy(name, value, p.policy))
+					if j > 0 {
+						pairs[j] = " " + pairs[j]
+					}
+					break
+				}
+			}
+		}
+		lines[i] = strings.Join(pairs, ";")
+	}
+}
+
+// cookieValue drops the bytes a cookie value can't hold, e.g. the ';' ending entities
+func cookieValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; 0x20 < c && c < 0x7f && c != '"' && c != ';' && c != '\\' && c != ',' {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func (p *Defender) HandleJson(c *gin.Context) error {
+	return p.handleJson(c.Request)
+}
+
+func (p *Defender) handleJson(req *http.Request) (err error) {
+	defer wrapError(&err, "json")
+	if req.Body == nil {
+		return nil
+	}
+	p.limitBody(req)
+
+	if p.streamingJSON {
+		return p.handleJsonStream(req)
+	}
+
+	// chunked requests carry no Content-Length, so look at the body itself
+	var raw bytes.Buffer
+	if _, err := raw.ReadFrom(req.Body); err != nil {
 		return err
 	}
+	if raw.Len() == 0 {
+		setBody(req, raw.Bytes())
+		return nil
+	}
 
-	buff, err := p.jsonToStringMap(jsonBod)
+	jsonBod, err := decodeJson(bytes.NewReader(raw.Bytes()), p.maxJSONDepth, p.duplicateKeys)
+	if err != nil && err != errNotJson {
+		return err
+	}
+	if err != nil {
+		// not ours to reject, the handler decides how to answer malformed JSON
+		setBody(req, raw.Bytes())
+		return nil
+	}
+
+	buff, err := p.jsonToStringMap(jsonBod, p.policy)
 	if err != nil {
 		return err
 	}
 
-	c.Request.Body = ioutil.NopCloser(&buff)
+	if p.preserveFormatting {
+		setBody(req, indentLike(raw.Bytes(), buff.Bytes()))
+		return nil
+	}
+	setBody(req, buff.Bytes())
 	return nil
 }
 
-func (p *Defender) jsonToStringMap(jsonBod interface{}) (bytes.Buffer, error) {
-	switch jbt := jsonBod.(type) {
-	case map[string]interface{}:
-		xmj := jsonBod.(map[string]interface{})
-		buff := p.ConstructJson(xmj)
+// SanitizeJSONBytes returns the sanitized version of the JSON document in, e.g. for records stored earlier.
+// Input holding anything but a single document, e.g. data following it, fails with errNotJson.
+func (p *Defender) SanitizeJSONBytes(in []byte) ([]byte, error) {
+	if !json.Valid(in) {
+		return nil, errNotJson
+	}
+	jsonBod, err := decodeJson(bytes.NewReader(in), p.maxJSONDepth, p.duplicateKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	buff, err := p.jsonToStringMap(jsonBod, p.policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// jsonToStringMap writes the decoded document jsonBod sanitized with policy, whether it is an object, an array or a scalar.
+// A panic while writing it, e.g. in a field transform, is returned as an *XSSError naming the field.
+func (p *Defender) jsonToStringMap(jsonBod interface{}, policy *bluemonday.Policy) (_ bytes.Buffer, err error) {
+	defer recoverJson(&err)
+
+	switch jsonBod.(type) {
+	case jsonObject, []interface{}, string, json.Number, bool, nil:
+		buff := p.buildJsonApplyPolicy(jsonBod, policy, "")
+		buff.Truncate(buff.Len() - 1) // remove last ','
 		return buff, nil
-	case []interface{}:
-		var multiRec bytes.Buffer
-		multiRec.WriteByte('[')
-		buff := bytes.Buffer{}
-		for _, n := range jbt {
-			xmj := n.(map[string]interface{})
-			buff = p.ConstructJson(xmj)
-			multiRec.WriteString(buff.String())
-			multiRec.WriteByte(',')
-		}
-		multiRec.Truncate(multiRec.Len() - 1) // remove last ','
-		multiRec.WriteByte(']')
-		return multiRec, nil
 	default:
 		return bytes.Buffer{}, errors.New("Unknown Content Type Received")
 	}
 }
 
-func (p *Defender) HandleXFormEncoded(c *gin.Context) error {
-	if c.Request.Body == nil {
+// sniffJson sanitizes the body of a request sent without Content-Type as JSON when it is JSON, see SetSniffContentType
+func (p *Defender) sniffJson(req *http.Request) (err error) {
+	defer wrapError(&err, "json")
+	if req.Body == nil {
 		return nil
 	}
+	p.limitBody(req)
 
-	// https://golang.org/src/net/http/httputil/dump.go
-	var buf bytes.Buffer
-	if _, err := buf.ReadFrom(c.Request.Body); err != nil {
+	var raw bytes.Buffer
+	if _, err := raw.ReadFrom(req.Body); err != nil {
 		return err
 	}
-
-	m, uerr := url.ParseQuery(buf.String())
-	if uerr != nil {
-		return uerr
+	setBody(req, raw.Bytes())
+	if !json.Valid(raw.Bytes()) {
+		return nil
 	}
+	return p.handleJson(req)
+}
+
+func (p *Defender) HandleXFormEncoded(c *gin.Context) error {
+	return p.handleXFormEncoded(c.Request)
+}
 
-	var bq bytes.Buffer
-	for k, v := range m {
-		//fmt.Println(k, " => ", v)
-		bq.WriteString(k)
-		bq.WriteByte('=')
+func (p *Defender) handleXFormEncoded(req *http.Request) (err error) {
+	defer wrapError(&err, "form")
+	var buf bytes.Buffer
+	if req.Body != nil {
+		p.limitBody(req)
 
-		// do fields to skip
-		var fndFld bool = false
-		for _, field := range p.skipFields {
-			if k == field {
-				bq.WriteString(url.QueryEscape(v[0]))
-				fndFld = true
-				break
-			}
+		// https://golang.org/src/net/http/httputil/dump.go
+		if _, err := buf.ReadFrom(req.Body); err != nil {
+			return err
+		}
+
+		if _, err := url.ParseQuery(buf.String()); err != nil {
+			return err
 		}
-		if !fndFld {
-			bq.WriteString(url.QueryEscape(p.policy.Sanitize(v[0])))
+
+		// keys and repeated values come back in the order they were sent
+		if buf.Len() > 0 {
+			setBody(req, []byte(p.sanitizeEncoded(buf.String(), nil)))
+		} else {
+			setBody(req, nil)
 		}
-		bq.WriteByte('&')
 	}
 
-	if bq.Len() > 1 {
-		bq.Truncate(bq.Len() - 1) // remove last '&'
-		bodOut := bq.String()
-		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(bodOut)))
-	} else {
-		c.Request.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(buf.String())))
+	// parsed earlier, e.g. by ParseForm in a previous middleware, which consumed the body. The values are counted
+	// and reported once, here when the body is gone, Form holds them again along with those of the query.
+	record := p
+	if buf.Len() > 0 {
+		record = p.quiet()
 	}
-
+	req.PostForm = record.SanitizeValues(req.PostForm)
+	req.Form = p.quiet().SanitizeValues(req.Form)
 	return nil
 }
 
 func (p *Defender) HandleMultiPartFormData(c *gin.Context, reqContentType string) error {
-	var ioreader io.Reader = c.Request.Body
+	return p.handleMultiPartFormData(c.Request, reqContentType)
+}
 
-	boundary := reqContentType[strings.Index(reqContentType, "boundary=")+9 : len(reqContentType)]
+func (p *Defender) handleMultiPartFormData(req *http.Request, reqContentType string) (err error) {
+	defer wrapError(&err, "multipart")
+	if req.Body == nil {
+		return nil
+	}
+	p.limitBody(req)
+
+	// parts are read as the client sends them, stop once the request is cancelled or times out
+	var ioreader io.Reader = &contextReader{ctx: req.Context(), r: req.Body}
+
+	mt, params, err := mime.ParseMediaType(reqContentType)
+	if err != nil {
+		return err
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return errNoBoundary
+	}
 
-	reader := multipart.NewReader(ioreader, boundary)
+	// what comes before the first part, written back as it is when there is none
+	head := &headCopy{}
+	reader := multipart.NewReader(io.TeeReader(ioreader, head), boundary)
 
 	var multiPrtFrm bytes.Buffer
-	// unknown, so make up some param limit - 100 max should be enough
-	for i := 0; i < 100; i++ {
-		part, err := reader.NextPart()
-		if err != nil {
-			//fmt.Println("didn't get a part")
+	writer := multipart.NewWriter(&multiPrtFrm)
+	// keep the boundary the client chose, unless the writer finds it invalid
+	boundaryChanged := writer.SetBoundary(boundary) != nil
+	for count := 0; ; count++ {
+		// raw parts keep their Content-Transfer-Encoding, like every other header
+		part, err := reader.NextRawPart()
+		if count == 0 && (err == io.EOF || err != nil && len(bytes.TrimSpace(head.buf.Bytes())) == 0) {
+			// an empty body, or one without parts, there is nothing to sanitize
+			req.Body = ioutil.NopCloser(bytes.NewReader(head.buf.Bytes()))
+			return nil
+		}
+		head.stop()
+		if err == io.EOF {
 			break
 		}
+		if err == nil && p.maxMultipartParts > 0 && count >= p.maxMultipartParts {
+			return errTooManyParts
+		}
+		if err != nil && req.Context().Err() != nil {
+			return err
+		}
+		if err != nil {
+			// a truncated or garbled body, what was read so far must not reach the handler unsanitized
+			return fmt.Errorf("malformed multipart body: %w", err)
+		}
 
+		// empty parts, e.g. an empty text input, are written back as they are
 		var buf bytes.Buffer
-		n, err := io.Copy(&buf, part)
+		var content io.Reader = part
+		if p.maxPartBytes > 0 {
+			content = io.LimitReader(part, p.maxPartBytes+1)
+		}
+		if _, err := io.Copy(&buf, content); err != nil {
+			if req.Context().Err() != nil {
+				return err
+			}
+			return fmt.Errorf("malformed multipart body: %w", err)
+		}
+		if p.maxPartBytes > 0 && int64(buf.Len()) > p.maxPartBytes {
+			return &XSSError{Phase: "multipart", Field: part.FormName(), Err: errPartTooLarge}
+		}
+		// every header is written back as it was received
+		w, err := writer.CreatePart(part.Header)
 		if err != nil {
-			//fmt.Println("error reading part: %v\nread so far: %q", err, buf.String())
 			return err
 		}
-		// XXX needed?
-		if n <= 0 {
-			//fmt.Println("read %d bytes; expected >0", n)
-			return errors.New("error recreating Multipart form Request")
-		}
-		// https://golang.org/src/mime/multipart/multipart_test.go line 230
-		multiPrtFrm.WriteString(`--` + boundary + "\r\n")
-		// dont sanitize file content
-		if part.FileName() != "" {
-			fn := part.FileName()
-			mtype := part.Header.Get("Content-Type")
-			multiPrtFrm.WriteString(`Content-Disposition: form-data; name="` + part.FormName() + "\"; ")
-			multiPrtFrm.WriteString(`filename="` + fn + "\";\r\n")
-			// default to application/octet-stream
-			if mtype == "" {
-				mtype = `application/octet-stream`
+		// dont sanitize file content, unless asked to for this file, nor binary parts of other multipart types
+		if (part.FileName() != "" && !p.isSanitizedFile(part)) || p.isSkipField(part.FormName(), part.FormName()) ||
+			(mt != "multipart/form-data" && !isTextPart(part)) {
+			w.Write(buf.Bytes())
+			continue
+		}
+		// mime/multipart decodes quoted-printable parts for the handler, sanitize what it will read and encode it back
+		var qp *quotedprintable.Writer
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+			plain, err := ioutil.ReadAll(quotedprintable.NewReader(&buf))
+			if err != nil {
+				return fmt.Errorf("malformed multipart body: %w", err)
 			}
-			multiPrtFrm.WriteString(`Content-Type: ` + mtype + "\r\n\r\n")
-			multiPrtFrm.WriteString(buf.String() + "\r\n")
+			buf.Reset()
+			buf.Write(plain)
+			qp = quotedprintable.NewWriter(w)
+			w = qp
+		}
+		if clean, ok := p.sanitizeJsonPart(part, buf.Bytes()); ok {
+			w.Write(clean)
 		} else {
-			multiPrtFrm.WriteString(`Content-Disposition: form-data; name="` + part.FormName() + "\";\r\n\r\n")
-			p := bluemonday.StrictPolicy()
-			if "password" == part.FormName() {
-				multiPrtFrm.WriteString(buf.String() + "\r\n")
-			} else {
-				multiPrtFrm.WriteString(p.Sanitize(buf.String()) + "\r\n")
+			policy := p.fieldPolicy(part.FormName(), part.FormName(), p.policy)
+			io.WriteString(w, p.sanitizeValue(part.FormName(), buf.String(), policy))
+		}
+		if qp != nil {
+			if err := qp.Close(); err != nil {
+				return err
 			}
 		}
 	}
-	multiPrtFrm.WriteString("--" + boundary + "--\r\n")
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if boundaryChanged {
+		params["boundary"] = writer.Boundary()
+		req.Header.Set("Content-Type", mime.FormatMediaType(mt, params))
+	}
+	setBody(req, multiPrtFrm.Bytes())
+
+	return nil
+}
+
+// sanitizeJsonPart returns the sanitized content of a part named by SetMultipartJSONFields. Parts not named, or
+// not holding JSON, are not handled and are sanitized as text.
+func (p *Defender) sanitizeJsonPart(part *multipart.Part, content []byte) ([]byte, bool) {
+	if !matchPath(p.multipartJSONFields, part.FormName()) || !json.Valid(content) {
+		return nil, false
+	}
+	clean, err := p.SanitizeJSONBytes(content)
+	if err != nil {
+		return nil, false
+	}
+	return clean, true
+}
+
+// headCopy keeps a copy of what is written to it until stop is called
+type headCopy struct {
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (c *headCopy) Write(b []byte) (int, error) {
+	if !c.stopped {
+		c.buf.Write(b)
+	}
+	return len(b), nil
+}
 
-	//fmt.Println("MultiPartForm Out %v", multiPrtFrm.String())
+func (c *headCopy) stop() {
+	c.stopped = true
+	c.buf = bytes.Buffer{}
+}
+
+// contextReader reads from r until ctx is done, even when a read is blocked on a client that stopped sending. That
+// read is left to end once the server closes the body, nothing is read afterwards.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+	buf []byte
+}
 
-	c.Request.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(multiPrtFrm.String())))
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	// read into a buffer of our own, b belongs to the caller again once Read returns
+	if cap(r.buf) < len(b) {
+		r.buf = make([]byte, len(b))
+	}
+	buf := r.buf[:len(b)]
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.r.Read(buf)
+		done <- readResult{n, err}
+	}()
+	select {
+	case res := <-done:
+		return copy(b, buf[:res.n]), res.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+// isTextPart reports whether part holds text, parts without Content-Type are text/plain
+func isTextPart(part *multipart.Part) bool {
+	ct := part.Header.Get("Content-Type")
+	return ct == "" || strings.HasPrefix(mediaType(ct), "text/")
+}
 
+// isSanitizedFile reports whether the content of the file part must be sanitized, see SetSanitizeFileParts
+func (p *Defender) isSanitizedFile(part *multipart.Part) bool {
+	return p.sanitizeFilePart != nil && p.sanitizeFilePart(part.FileName(), part.Header.Get("Content-Type"))
+}
+
+// SanitizeText is a BodyHandler running the whole body through the policy, e.g. for text/plain
+func SanitizeText(defender *Defender, req *http.Request) error {
+	if req.Body == nil {
+		return nil
+	}
+	defender.limitBody(req)
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(req.Body); err != nil {
+		return err
+	}
+
+	setBody(req, []byte(defender.applyPolicy("", buf.String(), defender.policy)))
 	return nil
 }
 
 func (p *Defender) HandleGETRequest(c *gin.Context) error {
-	queryParams := c.Request.URL.Query()
-	var fieldToSkip = map[string]bool{}
-	for _, fts := range p.skipFields {
-		fieldToSkip[fts] = true
+	return p.handleQuery(c.Request)
+}
+
+// handleQuery sanitizes the query parameters in place, they keep their order and, unless altered, their encoding
+func (p *Defender) handleQuery(req *http.Request) (err error) {
+	defer wrapError(&err, "query")
+	if req.URL.RawQuery == "" {
+		return nil
 	}
-	for key, items := range queryParams {
-		if fieldToSkip[key] {
+	if p.maxQueryParams > 0 && strings.Count(req.URL.RawQuery, "&") >= p.maxQueryParams {
+		return errTooManyParams
+	}
+	req.URL.RawQuery = p.sanitizeEncoded(req.URL.RawQuery, p.queryAllowlist)
+	// parsed earlier, e.g. by ParseForm in a previous middleware, from the unsanitized query
+	req.Form = p.quiet().sanitizeValues(req.Form, p.queryAllowlist)
+	return nil
+}
+
+// quiet returns a copy of p that sanitizes without counting nor reporting, for values sanitized elsewhere already
+func (p *Defender) quiet() *Defender {
+	q := *p
+	q.pass = nil
+	q.reporter = nil
+	return &q
+}
+
+// sanitizeEncoded sanitizes the values of the URL encoded pairs of raw in place, only those of the keys in allowlist
+// unless it is empty. Keys, the order of the pairs and the encoding of the values left unaltered are kept as they
+// were, pairs that can't be decoded too.
+func (p *Defender) sanitizeEncoded(raw string, allowlist []string) string {
+	pairs := strings.Split(raw, "&")
+	for i, pair := range pairs {
+		rawKey, rawValue := pair, ""
+		if eq := strings.Index(pair, "="); eq >= 0 {
+			rawKey, rawValue = pair[:eq], pair[eq+1:]
+		}
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil || !allowed(allowlist, key) {
 			continue
 		}
-		queryParams.Del(key)
-		for _, item := range items {
-			queryParams.Set(key, p.policy.Sanitize(item))
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			continue
+		}
+		if clean := p.sanitizeFormValue(key, value); clean != value {
+			pairs[i] = rawKey + "=" + url.QueryEscape(clean)
 		}
 	}
-	c.Request.URL.RawQuery = queryParams.Encode()
-	return nil
+	return strings.Join(pairs, "&")
 }
 
-func (p *Defender) buildJsonApplyPolicy(interf interface{}, policy *bluemonday.Policy) bytes.Buffer {
+// SanitizeValues returns a copy of v with every value sanitized, e.g. for a form parsed before the Defender ran.
+// Repeated values are all kept, in order, values of skip fields are copied as they are.
+func (p *Defender) SanitizeValues(v url.Values) url.Values {
+	return p.sanitizeValues(v, nil)
+}
+
+// sanitizeValues is SanitizeValues for the keys in allowlist only, unless it is empty
+func (p *Defender) sanitizeValues(v url.Values, allowlist []string) url.Values {
+	if v == nil {
+		return nil
+	}
+	res := make(url.Values, len(v))
+	for key, values := range v {
+		clean := make([]string, len(values))
+		for i, value := range values {
+			clean[i] = value
+			if allowed(allowlist, key) {
+				clean[i] = p.sanitizeFormValue(key, value)
+			}
+		}
+		res[key] = clean
+	}
+	return res
+}
+
+// allowed reports whether key is in allowlist, any key is when allowlist is empty
+func allowed(allowlist []string, key string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	for _, k := range allowlist {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeFormValue returns the value of the query or form parameter key sanitized
+func (p *Defender) sanitizeFormValue(key, value string) string {
+	if p.isSkipField(key, key) {
+		return value
+	}
+	return p.sanitizeValue(key, value, p.fieldPolicy(key, key, p.policy))
+}
+
+// buildJsonApplyPolicy writes interf followed by a ',', path is the dotted path of the value within the document
+func (p *Defender) buildJsonApplyPolicy(interf interface{}, policy *bluemonday.Policy, path string) bytes.Buffer {
+	defer func() {
+		// the innermost value names the field, outer ones pass it on
+		if r := recover(); r != nil {
+			if _, ok := r.(jsonPanic); ok {
+				panic(r)
+			}
+			panic(jsonPanic{path: path, value: r})
+		}
+	}()
+
 	var buff bytes.Buffer
 	switch v := interf.(type) {
+	case jsonObject:
+		bf := p.constructJson(v, policy, path)
+		buff.WriteString(bf.String())
+		buff.WriteByte(',')
+	case Json:
+		bf := p.constructJson(sortedObject(v), policy, path)
+		buff.WriteString(bf.String())
+		buff.WriteByte(',')
 	case map[string]interface{}:
-		bf := p.ConstructJson(v)
+		bf := p.constructJson(sortedObject(v), policy, path)
 		buff.WriteString(bf.String())
 		buff.WriteByte(',')
 	case []interface{}:
-		bf := p.unravelSlice(v, policy)
+		bf := p.unravelSlice(v, policy, path)
 		buff.WriteString(bf.String())
 		buff.WriteByte(',')
 	case json.Number:
-		buff.WriteString(policy.Sanitize(fmt.Sprintf("%v", v)))
+		// numbers can't carry markup, keep the literal as sent
+		buff.WriteString(v.String())
 		buff.WriteByte(',')
 	case string:
-		buff.WriteString(fmt.Sprintf("%q", policy.Sanitize(v)))
+		buff.WriteString(quoteJson(p.sanitizeValue(path, v, policy)))
 		buff.WriteByte(',')
 	case float64:
-		buff.WriteString(policy.Sanitize(strconv.FormatFloat(v, 'g', 0, 64)))
+		buff.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		buff.WriteByte(',')
+	case bool:
+		// booleans can't carry markup either
+		buff.WriteString(strconv.FormatBool(v))
 		buff.WriteByte(',')
 	default:
 		if v == nil {
 			buff.WriteString(fmt.Sprintf("%s", "null"))
 			buff.WriteByte(',')
 		} else {
-			buff.WriteString(policy.Sanitize(fmt.Sprintf("%v", v)))
+			buff.WriteString(sanitizeWith(policy, fmt.Sprintf("%v", v)))
 			buff.WriteByte(',')
 		}
 	}
 	return buff
 }
 
-func (p *Defender) unravelSlice(ss []interface{}, policy *bluemonday.Policy) bytes.Buffer {
+// jsonPanic carries a panic raised while writing the value at path up to recoverJson
+type jsonPanic struct {
+	path  string
+	value interface{}
+}
+
+// recoverJson, deferred, turns a jsonPanic into an *XSSError naming the field, stored in err. Other panics go on.
+func recoverJson(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	jp, ok := r.(jsonPanic)
+	if !ok {
+		panic(r)
+	}
+	*err = &XSSError{Phase: "json", Field: jp.path, Err: fmt.Errorf("sanitizing panicked: %v", jp.value)}
+}
+
+// unravelSlice writes ss as a JSON array, its elements share the path of the array itself
+func (p *Defender) unravelSlice(ss []interface{}, policy *bluemonday.Policy, path string) bytes.Buffer {
 	var buff bytes.Buffer
 	buff.WriteByte('[')
 	for _, item := range ss {
-		switch tp := item.(type) {
-		case map[string]interface{}:
-			bf := p.ConstructJson(tp)
-			buff.WriteString(bf.String())
-			buff.WriteByte(',')
-		case string:
-			buff.WriteString(fmt.Sprintf("%q", policy.Sanitize(tp)))
-			buff.WriteByte(',')
-		}
+		bf := p.buildJsonApplyPolicy(item, policy, path)
+		buff.WriteString(bf.String())
+	}
+	if len(ss) > 0 {
+		buff.Truncate(buff.Len() - 1) // remove last ','
 	}
-	buff.Truncate(buff.Len() - 1) // remove last ','
 	buff.WriteByte(']')
 	return buff
 }
 
+// sanitizeValue returns value sanitized with policy, field names where value was found for reporting.
+// The transform of the field, if any, runs first. Values outside the fields set with SetOnlySanitizeFields
+// are returned as they are then.
+func (p *Defender) sanitizeValue(field, value string, policy *bluemonday.Policy) string {
+	if p.skipEmptyValues && value == "" {
+		return value
+	}
+	if transform := p.fieldTransform(field); transform != nil {
+		value = transform(value)
+	}
+	if len(p.onlyFields) > 0 && !matchPath(p.onlyFields, field) {
+		return value
+	}
+	if matchPath(p.urlFields, field) {
+		return p.recordValue(field, value, cleanURL(value))
+	}
+	if matchPath(p.dataURIFields, field) {
+		return p.recordValue(field, value, cleanDataURI(value))
+	}
+	if matchPath(p.stripFields, field) {
+		return p.recordValue(field, value, entityStripper.Replace(sanitizeWith(stripPolicy, value)))
+	}
+	return p.applyPolicy(field, value, policy)
+}
+
+// applyPolicy returns value sanitized with policy whatever field it was found in, e.g. for configured headers
+func (p *Defender) applyPolicy(field, value string, policy *bluemonday.Policy) string {
+	clean := value
+	if p.normalize {
+		clean = p.normalization.String(clean)
+	}
+	clean = sanitizeWith(policy, clean)
+	if p.entityEncoding == StripEntities && policy != identityPolicy {
+		clean = entityStripper.Replace(clean)
+	}
+	return p.recordValue(field, value, clean)
+}
+
+// recordValue accounts for value found in field being sanitized into clean, which it returns
+func (p *Defender) recordValue(field, value, clean string) string {
+	if p.pass != nil {
+		p.pass.metrics.FieldsInspected++
+		p.pass.metrics.BytesIn += len(value)
+		p.pass.metrics.BytesOut += len(clean)
+	}
+	if clean != value {
+		if p.reporter != nil {
+			p.reporter(field, value, clean)
+		}
+		if p.pass != nil {
+			p.pass.modified = append(p.pass.modified, field)
+			p.pass.metrics.FieldsModified++
+		}
+	}
+	return clean
+}
+
+// isNotHtml reports whether the member key of obj has a format indicator sibling saying it isn't HTML,
+// see SetFormatIndicator
+func (p *Defender) isNotHtml(obj jsonObject, key string) bool {
+	if p.formatSuffix == "" {
+		return false
+	}
+	for _, field := range obj {
+		if field.key == key+p.formatSuffix {
+			format, ok := field.value.(string)
+			return !ok || format != p.formatHTML
+		}
+	}
+	return false
+}
+
+// isSkipField reports whether the field at the dotted path, named key, must be left unsanitized
+func (p *Defender) isSkipField(path, key string) bool {
+	for _, field := range p.skipFields {
+		if matchField(field, path, key) {
+			return true
+		}
+		if p.skipFieldsFold && matchField(strings.ToLower(field), strings.ToLower(path), strings.ToLower(key)) {
+			return true
+		}
+	}
+	for _, pattern := range p.skipFieldPatterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldTransform returns the transform set for the field at the dotted path, or for its last element
+func (p *Defender) fieldTransform(path string) func(string) string {
+	if transform, ok := p.fieldTransforms[path]; ok {
+		return transform
+	}
+	return p.fieldTransforms[path[strings.LastIndex(path, ".")+1:]]
+}
+
+// matchPath reports whether one of fields matches the field at the dotted path, named after its last element
+func matchPath(fields []string, path string) bool {
+	key := path[strings.LastIndex(path, ".")+1:]
+	for _, field := range fields {
+		if matchField(field, path, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanURL returns value when it parses as a relative, http, https or mailto URL, an empty string otherwise.
+// url.Parse takes markup as a relative path, so URLs holding quotes, angle brackets, spaces or control
+// characters, which are percent-encoded in a valid URL, are cleared as well.
+func cleanURL(value string) string {
+	if strings.ContainsAny(value, `<>"'`) || strings.IndexFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return value
+	}
+	return ""
+}
+
+// cleanDataURI returns value when it is a base64 data URI of a raster image, e.g. "data:image/png;base64,iVBO...",
+// an empty string otherwise. SVG images can carry scripts and aren't accepted.
+func cleanDataURI(value string) string {
+	if value == "" {
+		return value
+	}
+	comma := strings.IndexByte(value, ',')
+	if comma < 0 || !strings.HasPrefix(strings.ToLower(value), "data:") {
+		return ""
+	}
+	params := strings.Split(strings.ToLower(value[len("data:"):comma]), ";")
+	if len(params) < 2 || params[len(params)-1] != "base64" {
+		return ""
+	}
+	switch params[0] {
+	case "image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp":
+	default:
+		return ""
+	}
+	if _, err := base64.StdEncoding.DecodeString(value[comma+1:]); err != nil {
+		return ""
+	}
+	return value
+}
+
+// fieldPolicy returns the policy configured for the field at the dotted path, named key, or def when there is none.
+// A policy registered for the whole path wins over one registered for the bare key.
+func (p *Defender) fieldPolicy(path, key string, def *bluemonday.Policy) *bluemonday.Policy {
+	if policy, ok := p.fieldPolicies[path]; ok {
+		return policy
+	}
+	if policy, ok := p.fieldPolicies[key]; ok {
+		return policy
+	}
+	return def
+}
+
+// matchField reports whether a configured field matches the field at the dotted path, named key.
+// Configured fields containing a dot match the whole path, bare names match the key at any depth.
+func matchField(field, path, key string) bool {
+	if strings.Contains(field, ".") {
+		return path == field
+	}
+	return key == field
+}
+
+// joinPath appends key to the dotted path parent
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// ConstructJson writes mp as a sanitized JSON object, with its keys sorted. A panic while writing it, e.g. in a
+// field transform, is raised again as an *XSSError naming the field.
 func (p *Defender) ConstructJson(mp Json) bytes.Buffer {
+	buff, err := p.jsonToStringMap(sortedObject(mp), p.policy)
+	if err != nil {
+		panic(err)
+	}
+	return buff
+}
+
+// constructJson writes obj as a JSON object, fields without a policy of their own are sanitized with policy
+func (p *Defender) constructJson(obj jsonObject, policy *bluemonday.Policy, path string) bytes.Buffer {
 	var buff bytes.Buffer
 	buff.WriteByte('{')
 
-	for k, v := range mp {
-		buff.WriteByte('"')
-		buff.WriteString(k)
-		buff.WriteByte('"')
+	for _, field := range obj {
+		k, v := field.key, field.value
+		buff.WriteString(quoteJson(k))
 		buff.WriteByte(':')
 
 		// do fields to skip
-		var fndFld bool = false
-		for _, fts := range p.skipFields {
-			if string(k) == fts {
-				//buff.WriteString(`"` + fmt.Sprintf("%s", v) + `",`)
-				buff.WriteString(fmt.Sprintf("%q", v))
-				buff.WriteByte(',')
-				fndFld = true
-				break
-			}
-		}
-		if fndFld {
+		fieldPath := joinPath(path, k)
+		if p.isSkipField(fieldPath, k) || p.isNotHtml(obj, k) {
+			// the value is copied whatever its type, objects and arrays keep their structure
+			raw, _ := marshalJson(v)
+			buff.WriteString(raw)
+			buff.WriteByte(',')
 			continue
 		}
 
-		apndBuff := p.buildJsonApplyPolicy(v, p.policy)
+		apndBuff := p.buildJsonApplyPolicy(v, p.fieldPolicy(fieldPath, k, policy), fieldPath)
 		buff.WriteString(apndBuff.String())
 	}
-	buff.Truncate(buff.Len() - 1) // remove last ','
+	if len(obj) > 0 {
+		buff.Truncate(buff.Len() - 1) // remove last ','
+	}
 	buff.WriteByte('}')
 
 	return buff
 }
 
-func decodeJson(content io.Reader) (interface{}, error) {
-	var jsonBod interface{}
+// decodeJson decodes the first JSON value of content, objects are decoded as jsonObject to keep their key order.
+// Objects and arrays may nest maxDepth levels deep, any number when maxDepth isn't positive.
+func decodeJson(content io.Reader, maxDepth int, duplicates DuplicateKeyPolicy) (interface{}, error) {
 	d := json.NewDecoder(content)
 	d.UseNumber()
-	err := d.Decode(&jsonBod)
+	if maxDepth <= 0 {
+		maxDepth = -1
+	}
+	jsonBod, err := decodeValue(d, maxDepth, duplicates)
+	if err == errTooDeep || errors.Is(err, errDuplicateKey) {
+		return nil, err
+	}
 	if err != nil {
 		return nil, errNotJson
 	}
 	return jsonBod, err
 }
+
+// quoteJson returns s as a JSON string literal, escaping quotes, backslashes and control characters
+func quoteJson(s string) string {
+	quoted, _ := marshalJson(s)
+	return quoted
+}
+
+// mediaType returns the lower-cased media type of a Content-Type header value without its parameters. Values
+// mime can't parse, e.g. with a parameter lacking its value, are cut at the first semicolon or space, as gin does.
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = strings.TrimSpace(contentType)
+		if i := strings.IndexAny(mt, "; \t"); i >= 0 {
+			mt = mt[:i]
+		}
+		mt = strings.ToLower(mt)
+	}
+	return mt
+}
+
+// isJsonMediaType reports whether contentType is application/json or uses the +json suffix, e.g. application/ld+json
+func isJsonMediaType(contentType string) bool {
+	mt := mediaType(contentType)
+	return mt == "application/json" || strings.HasSuffix(mt, "+json")
+}
+
+// isXmlMediaType reports whether contentType is text/xml or application/xml
+func isXmlMediaType(contentType string) bool {
+	mt := mediaType(contentType)
+	return mt == "text/xml" || mt == "application/xml"
+}
+
+// defaultMaxDecodedBytes limits what a compressed request body decompresses to when SetMaxBodyBytes isn't used
+const defaultMaxDecodedBytes = 10 << 20
+
+// decodeBody decompresses a gzip or deflate encoded request body so that it can be sanitized, the body is then
+// passed on plain and the Content-Encoding header removed
+func (p *Defender) decodeBody(req *http.Request) (err error) {
+	defer wrapError(&err, "body")
+	if req.Body == nil {
+		return nil
+	}
+
+	var decoded io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(req.Body)
+	case "deflate":
+		decoded, err = zlib.NewReader(req.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer decoded.Close()
+
+	// the limit applies to what the body decompresses to
+	limit := int64(defaultMaxDecodedBytes)
+	if p.maxBodyBytes > 0 {
+		limit = p.maxBodyBytes
+	}
+	decoded = http.MaxBytesReader(nil, decoded, limit)
+	plain, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Del("Content-Encoding")
+	setBody(req, plain)
+	return nil
+}
+
+// limitBody makes reading req.Body fail once more than the configured maximum has been read
+func (p *Defender) limitBody(req *http.Request) {
+	if p.maxBodyBytes > 0 {
+		req.Body = http.MaxBytesReader(nil, req.Body, p.maxBodyBytes)
+	}
+}
+
+// SanitizedBody returns the request body as RemoveXSS rewrote it, whether or not it was read since.
+// It is nil when the body was left alone, e.g. for content types that aren't sanitized.
+func (p *Defender) SanitizedBody(c *gin.Context) []byte {
+	if cb, ok := c.Get(gin.BodyBytesKey); ok {
+		if body, ok := cb.([]byte); ok {
+			return body
+		}
+	}
+	return nil
+}
+
+// sanitizedBody is a request body rewritten by setBody
+type sanitizedBody struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (b *sanitizedBody) Close() error {
+	return nil
+}
+
+// setBody replaces the request body and keeps its length in sync. req.Trailer and req.TransferEncoding are kept: the server fills the
+// trailers in once the original body has been read to its end, so they reach the handler, or a proxy forwarding req.
+func setBody(req *http.Request, body []byte) {
+	req.Body = &sanitizedBody{Reader: bytes.NewReader(body), data: body}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
@@ -2,20 +2,31 @@ package xss
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/unicode/norm"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // see https://raw.githubusercontent.com/gin-gonic/contrib/master/secure/secure_test.go
@@ -149,6 +160,76 @@ func newServer(defender *Defender) *gin.Engine {
 		c.String(201, "123")
 	})
 
+	r.POST("/response_created", func(c *gin.Context) {
+		c.Status(201)
+		c.Header("Content-Type", "application/json")
+		c.Writer.WriteString(`{"comment":"<script>alert(0)</script>ok"}`)
+	})
+
+	r.POST("/response_sized", func(c *gin.Context) {
+		body := `{"comment":"<script>alert(0)</script>ok"}`
+		c.Header("Content-Length", strconv.Itoa(len(body)))
+		c.Data(200, "application/json", []byte(body))
+	})
+
+	r.POST("/response_json", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.Data(200, "application/json", body)
+	})
+
+	r.POST("/response_echo", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.Data(200, c.GetHeader("Content-Type"), body)
+	})
+
+	r.POST("/response_accepted", func(c *gin.Context) {
+		c.Status(202)
+	})
+
+	r.GET("/response_status/:code", func(c *gin.Context) {
+		code, _ := strconv.Atoi(c.Param("code"))
+		c.JSON(code, gin.H{"msg": "<b>" + c.Param("code") + "</b>"})
+	})
+
+	return r
+}
+
+// Test request sanitization as Gin Middleware, handlers echo what they received
+func newInboundServer(defender *Defender) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+
+	r.Use(defender.RemoveXSS())
+
+	echo := func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.Data(200, c.GetHeader("Content-Type"), body)
+	}
+	r.POST("/echo", echo)
+	r.POST("/webhooks/:name", echo)
+	r.DELETE("/echo", echo)
+	r.GET("/headers", func(c *gin.Context) {
+		c.JSON(200, c.Request.Header)
+	})
+	r.GET("/query", func(c *gin.Context) {
+		c.String(200, c.Request.URL.RawQuery)
+	})
+	r.HEAD("/query", func(c *gin.Context) {
+		c.Header("X-Query", c.Request.URL.RawQuery)
+		c.Status(200)
+	})
+	r.GET("/users/:name/profile", func(c *gin.Context) {
+		c.JSON(200, gin.H{"name": c.Param("name"), "path": c.Request.URL.Path, "raw": c.Request.URL.EscapedPath()})
+	})
+	r.POST("/length", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.JSON(200, gin.H{
+			"header":         c.GetHeader("Content-Length"),
+			"content_length": c.Request.ContentLength,
+			"body":           len(body),
+		})
+	})
+
 	return r
 }
 
@@ -476,7 +557,7 @@ func TestKeepsValuesStripsHtmlOnPut(t *testing.T) {
 	assert.JSONEq(t, expect, resp.Body.String())
 }
 
-func TestXssSkippedOnNoContentLength(t *testing.T) {
+func TestXssAppliedOnNoContentLength(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer log.SetOutput(os.Stderr)
 
@@ -505,7 +586,9 @@ func TestXssSkippedOnNoContentLength(t *testing.T) {
             "cre_at":%v
         }`
 
-	expect := fmt.Sprintf(expStr, user, email, password, cmnt, cre_at)
+	cmnt_clnd := `` // malicious markup content stripped
+
+	expect := fmt.Sprintf(expStr, user, email, password, cmnt_clnd, cre_at)
 	assert.JSONEq(t, expect, resp.Body.String())
 }
 
@@ -840,3 +923,3376 @@ func TestPassNotJSONResponseFilter(t *testing.T) {
 	expect := "123"
 	assert.JSONEq(t, expect, resp.Body.String())
 }
+
+func TestKeepsNumbersIntact(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"a":19.99,"b":1e-7,"c":0.1}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(oParams)))
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, oParams, resp.Body.String())
+	assert.Contains(t, resp.Body.String(), `"a":19.99`)
+	assert.Contains(t, resp.Body.String(), `"b":1e-7`)
+	assert.Contains(t, resp.Body.String(), `"c":0.1`)
+
+	// float64 values built outside the decoder keep full precision too
+	defender := DefaultDefender()
+	for in, out := range map[float64]string{19.99: `{"a":19.99}`, 1e-7: `{"a":1e-07}`, 0.1: `{"a":0.1}`} {
+		buff := defender.ConstructJson(Json{"a": in})
+		assert.Equal(t, out, buff.String())
+	}
+}
+
+func TestKeepsEveryArrayElementKind(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	tests := []struct {
+		name   string
+		body   string
+		expect string
+	}{
+		{"numbers", `{"tags":[1,2.5,3]}`, `{"tags":[1,2.5,3]}`},
+		{"booleans", `{"flags":[true,false]}`, `{"flags":[true,false]}`},
+		{"nulls", `{"holes":[null,"a",null]}`, `{"holes":[null,"a",null]}`},
+		{"nested arrays", `{"matrix":[[1,2],[3,4]]}`, `{"matrix":[[1,2],[3,4]]}`},
+		{"nested objects", `{"users":[{"name":"<b>bob</b>"}]}`, `{"users":[{"name":"bob"}]}`},
+		{"strings", `{"ids":["<script>x</script>ok","b"]}`, `{"ids":["ok","b"]}`},
+		{"mixed", `{"mix":[1,"<i>a</i>",true,null,[2],{"k":"v"}]}`, `{"mix":[1,"a",true,null,[2],{"k":"v"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Add("Content-Length", strconv.Itoa(len(tt.body)))
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.JSONEq(t, tt.expect, resp.Body.String())
+		})
+	}
+}
+
+func TestKeepsBooleansIntact(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"active":true,"deleted":false}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(oParams)))
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, oParams, resp.Body.String())
+	assert.Contains(t, resp.Body.String(), `"active":true`)
+	assert.Contains(t, resp.Body.String(), `"deleted":false`)
+}
+
+func TestKeepsEmptyObjectsAndArrays(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	for _, oParams := range []string{`{}`, `[]`, `{"a":{}}`, `{"a":[]}`, `{"a":[{},[]]}`} {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Content-Length", strconv.Itoa(len(oParams)))
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, oParams, resp.Body.String())
+	}
+}
+
+func TestEscapesJsonKeys(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"a\"b":"x","c\\d":"y","e\nf":"z","ünï\u00e7ødé":"w"}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", strconv.Itoa(len(oParams)))
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	var got map[string]string
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, map[string]string{"a\"b": "x", "c\\d": "y", "e\nf": "z", "ünïçødé": "w"}, got)
+}
+
+func TestSanitizesJsonMediaTypes(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8", "application/vnd.api+json", "Application/JSON"} {
+		oParams := `{"comment":"<script>alert(0)</script>ok"}`
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Content-Length", strconv.Itoa(len(oParams)))
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, contentType)
+		assert.JSONEq(t, `{"comment":"ok"}`, resp.Body.String(), contentType)
+	}
+}
+
+func TestXssAppliedOnChunkedPost(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"comment":"<script>alert(0)</script>ok"}`
+	req, _ := http.NewRequest("POST", "/echo", ioutil.NopCloser(strings.NewReader(oParams)))
+	req.Header.Add("Content-Type", "application/json")
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, `{"comment":"ok"}`, resp.Body.String())
+}
+
+func TestEmptyJsonBodyPassesThrough(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	req, _ := http.NewRequest("POST", "/echo", ioutil.NopCloser(strings.NewReader("")))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "", resp.Body.String())
+}
+
+func TestUpdatesContentLengthOfRewrittenBody(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	values := url.Values{}
+	values.Set("comment", `<img src=x onerror=alert(0)>ok`)
+	form := values.Encode()
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("comment", `<img src=x onerror=alert(0)>ok`)
+	assert.Nil(t, writer.Close())
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"json", "application/json", `{"comment":"<img src=x onerror=alert(0)>ok"}`},
+		{"form", "application/x-www-form-urlencoded", form},
+		{"multipart", writer.FormDataContentType(), body.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/length", strings.NewReader(tt.body))
+			req.Header.Add("Content-Type", tt.contentType)
+			req.Header.Add("Content-Length", strconv.Itoa(len(tt.body)))
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			var got struct {
+				Header        string `json:"header"`
+				ContentLength int64  `json:"content_length"`
+				Body          int64  `json:"body"`
+			}
+			assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &got))
+			assert.Less(t, got.Body, int64(len(tt.body)))
+			assert.Equal(t, got.Body, got.ContentLength)
+			assert.Equal(t, strconv.FormatInt(got.Body, 10), got.Header)
+		})
+	}
+}
+
+func TestMultiPartFormDataHonorsSkipFields(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetSkipFields("token", "secret")))
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("token", `<b>tok</b>`)
+	_ = writer.WriteField("secret", `<i>sec</i>`)
+	_ = writer.WriteField("comment", `<b>cmnt</b>`)
+	assert.Nil(t, writer.Close())
+
+	req, _ := http.NewRequest("POST", "/echo", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	form := parseMultipart(t, resp)
+	assert.Equal(t, `<b>tok</b>`, form.Value["token"][0])
+	assert.Equal(t, `<i>sec</i>`, form.Value["secret"][0])
+	assert.Equal(t, `cmnt`, form.Value["comment"][0])
+}
+
+// parseMultipart reads back a multipart form echoed by the inbound server
+func parseMultipart(t *testing.T, resp *httptest.ResponseRecorder) *multipart.Form {
+	_, params, err := mime.ParseMediaType(resp.Header().Get("Content-Type"))
+	assert.Nil(t, err)
+	form, err := multipart.NewReader(resp.Body, params["boundary"]).ReadForm(1 << 20)
+	assert.Nil(t, err)
+	return form
+}
+
+func TestMultiPartFormDataUsesConfiguredPolicy(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetPolicy(bluemonday.UGCPolicy())))
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("comment", `<b>bold</b><script>alert(0)</script>`)
+	assert.Nil(t, writer.Close())
+
+	req, _ := http.NewRequest("POST", "/echo", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	form := parseMultipart(t, resp)
+	assert.Equal(t, `<b>bold</b>`, form.Value["comment"][0])
+}
+
+func TestMultiPartFormDataKeepsEveryPart(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for i := 0; i < 150; i++ {
+		_ = writer.WriteField("field"+strconv.Itoa(i), "<b>"+strconv.Itoa(i)+"</b>")
+	}
+	assert.Nil(t, writer.Close())
+
+	req, _ := http.NewRequest("POST", "/echo", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	form := parseMultipart(t, resp)
+	assert.Len(t, form.Value, 150)
+	for i := 0; i < 150; i++ {
+		assert.Equal(t, strconv.Itoa(i), form.Value["field"+strconv.Itoa(i)][0])
+	}
+}
+
+func TestXssFiltersDeleteBody(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"filter":"<script>alert(0)</script>stale"}`
+	req, _ := http.NewRequest("DELETE", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, `{"filter":"stale"}`, resp.Body.String())
+}
+
+func TestKeepsMultiValuedQueryParams(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	req, _ := http.NewRequest("GET", "/query?tag=a&tag=<b>b</b>&tag=c", nil)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	query, err := url.ParseQuery(resp.Body.String())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, query["tag"])
+}
+
+func TestXssFiltersRegisteredContentType(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetExtraContentTypes(map[string]BodyHandler{"text/plain": SanitizeText})))
+
+	oParams := `hello <script>alert(0)</script><b>world</b>`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "text/plain; charset=utf-8")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `hello world`, resp.Body.String())
+
+	// unregistered types are left alone
+	req, _ = http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "text/csv")
+
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, oParams, resp.Body.String())
+}
+
+func TestSkipFieldsMatchDottedPaths(t *testing.T) {
+	tests := []struct {
+		name       string
+		skipFields []string
+		expect     string
+	}{
+		{"dotted", []string{"user.apiKey"}, `{"apiKey":"x","user":{"apiKey":"<b>x</b>","name":"bob"},"users":[{"apiKey":"x"}]}`},
+		{"dotted through arrays", []string{"users.apiKey"}, `{"apiKey":"x","user":{"apiKey":"x","name":"bob"},"users":[{"apiKey":"<b>x</b>"}]}`},
+		{"bare", []string{"apiKey"}, `{"apiKey":"<b>x</b>","user":{"apiKey":"<b>x</b>","name":"bob"},"users":[{"apiKey":"<b>x</b>"}]}`},
+	}
+
+	oParams := `{"apiKey":"<b>x</b>","user":{"apiKey":"<b>x</b>","name":"<i>bob</i>"},"users":[{"apiKey":"<b>x</b>"}]}`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(SetSkipFields(tt.skipFields...)))
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.JSONEq(t, tt.expect, resp.Body.String())
+		})
+	}
+}
+
+func TestFieldPoliciesOverrideDefaultPolicy(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetFieldPolicies(map[string]*bluemonday.Policy{
+		"bio":          bluemonday.UGCPolicy(),
+		"profile.note": bluemonday.UGCPolicy(),
+	})))
+
+	oParams := `{"username":"<b>bob</b>","bio":"<b>hi</b><script>alert(0)</script>","profile":{"note":"<i>n</i>","bio":"<b>b</b>","name":"<i>x</i>"},"note":"<i>n</i>"}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, `{"username":"bob","bio":"<b>hi</b>","profile":{"note":"<i>n</i>","bio":"<b>b</b>","name":"x"},"note":"n"}`, resp.Body.String())
+}
+
+func TestRemoveXSSHTTP(t *testing.T) {
+	defender := DefaultDefender()
+	s := defender.RemoveXSSHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.URL.RawQuery + " " + string(body)))
+	}))
+
+	oParams := `{"comment":"<script>alert(0)</script>ok"}`
+	req := httptest.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, ` {"comment":"ok"}`, resp.Body.String())
+
+	req = httptest.NewRequest("GET", "/echo?name=<b>bob</b>", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `name=bob `, resp.Body.String())
+
+	req = httptest.NewRequest("POST", "/echo", bytes.NewBufferString(`comment=%zz`))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestFilterXSSHTTP(t *testing.T) {
+	defender := DefaultDefender()
+	s := defender.FilterXSSHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/text" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(`<b>text</b>`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(`{"comment":"<script>alert(0)</script>ok"}`))
+	}))
+
+	req := httptest.NewRequest("GET", "/json", nil)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 201, resp.Code)
+	assert.JSONEq(t, `{"comment":"ok"}`, resp.Body.String())
+
+	req = httptest.NewRequest("GET", "/text", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `<b>text</b>`, resp.Body.String())
+}
+
+func TestFilterXSSHoldsBackFlush(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(DefaultDefender().FilterXSS())
+	r.GET("/flush", func(c *gin.Context) {
+		c.Status(201)
+		c.Header("Content-Type", "application/json")
+		c.Writer.WriteString(`{"comment":"<script>alert(0)</script>ok"}`)
+		c.Writer.Flush()
+	})
+
+	req := httptest.NewRequest("GET", "/flush", nil)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	assert.Equal(t, 201, resp.Code)
+	assert.Equal(t, `{"comment":"ok"}`, resp.Body.String())
+}
+
+func TestFilterKeepsContentLengthOfHead(t *testing.T) {
+	defender := DefaultDefender()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(defender.FilterXSS())
+	r.HEAD("/file", func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.Header("Content-Length", "1234")
+		c.Status(200)
+	})
+	h := defender.FilterXSSHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "1234")
+	}))
+
+	for _, s := range []http.Handler{r, h} {
+		req := httptest.NewRequest("HEAD", "/file", nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, "1234", resp.Header().Get("Content-Length"))
+	}
+}
+
+func TestMalformedJsonReachesHandler(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"comment":"<script>alert(0)</script>"`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, oParams, resp.Body.String())
+}
+
+func TestErrorHandler(t *testing.T) {
+	oParams := `comment=%zz`
+
+	s := newInboundServer(DefaultDefender())
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), `invalid URL escape`)
+
+	var got error
+	s = newInboundServer(DefaultDefender(SetErrorHandler(func(c *gin.Context, err error) {
+		got = err
+		c.String(422, "rejected")
+	})))
+	req, _ = http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 422, resp.Code)
+	assert.Equal(t, "rejected", resp.Body.String())
+	assert.NotNil(t, got)
+}
+
+func TestFiltersOnlySuccessfulResponses(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		defender *Defender
+		code     int
+		expect   string
+	}{
+		{DefaultDefender(), 200, `{"msg":"200"}`},
+		{DefaultDefender(), 500, `{"msg":"<b>500</b>"}`},
+		{DefaultDefender(), 404, `{"msg":"<b>404</b>"}`},
+		{DefaultDefender(SetFilterErrorResponses(true)), 500, `{"msg":"500"}`},
+	}
+
+	for _, tt := range tests {
+		s := newServer(tt.defender)
+		req, _ := http.NewRequest("GET", "/response_status/"+strconv.Itoa(tt.code), nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, tt.code, resp.Code)
+		var got map[string]string
+		assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &got))
+		var expect map[string]string
+		assert.Nil(t, json.Unmarshal([]byte(tt.expect), &expect))
+		assert.Equal(t, expect, got)
+	}
+}
+
+func TestFilterKeepsStatusCode(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := newServer(DefaultDefender())
+
+	req, _ := http.NewRequest("POST", "/response_created", nil)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 201, resp.Code)
+	assert.JSONEq(t, `{"comment":"ok"}`, resp.Body.String())
+
+	req, _ = http.NewRequest("POST", "/response_accepted", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 202, resp.Code)
+	assert.Empty(t, resp.Body.String())
+}
+
+func TestFilterUpdatesContentLength(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := newServer(DefaultDefender())
+
+	req, _ := http.NewRequest("POST", "/response_sized", nil)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, `{"comment":"ok"}`, resp.Body.String())
+	assert.Equal(t, strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
+
+	h := DefaultDefender().FilterXSSHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `{"comment":"<script>alert(0)</script>ok"}`
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write([]byte(body))
+	}))
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
+}
+
+func TestFilterMatchesJsonMediaTypes(t *testing.T) {
+	tests := []struct {
+		contentType string
+		filtered    bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/problem+json", true},
+		{"Application/JSON", true},
+		{"text/html; profile=application/json", false},
+		{"application/json-seq", false},
+	}
+
+	body := `{"comment":"<script>alert(0)</script>ok"}`
+	for _, tt := range tests {
+		h := DefaultDefender().FilterXSSHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Write([]byte(body))
+		}))
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+
+		assert.Equal(t, 200, resp.Code, tt.contentType)
+		if tt.filtered {
+			assert.JSONEq(t, `{"comment":"ok"}`, resp.Body.String(), tt.contentType)
+		} else {
+			assert.Equal(t, body, resp.Body.String(), tt.contentType)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetMaxBodyBytes(64)))
+
+	values := url.Values{}
+	values.Set("comment", "<b>ok</b>")
+	small := values.Encode()
+	values.Set("comment", strings.Repeat("<b>ok</b>", 10))
+	large := values.Encode()
+
+	smallJson := `{"comment":"<b>ok</b>"}`
+	largeJson := `{"comment":"` + strings.Repeat("<b>ok</b>", 10) + `"}`
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("comment", strings.Repeat("<b>ok</b>", 10))
+	assert.Nil(t, writer.Close())
+
+	tests := []struct {
+		contentType string
+		body        string
+		code        int
+	}{
+		{"application/x-www-form-urlencoded", small, 200},
+		{"application/x-www-form-urlencoded", large, 400},
+		{"application/json", smallJson, 200},
+		{"application/json", largeJson, 400},
+		{writer.FormDataContentType(), body.String(), 400},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", strings.NewReader(tt.body))
+		req.Header.Add("Content-Type", tt.contentType)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, tt.code, resp.Code, tt.body)
+		if tt.code == 400 {
+			assert.Contains(t, resp.Body.String(), "request body too large")
+		}
+	}
+}
+
+func TestSupportsTopLevelArrays(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	tests := []struct {
+		name   string
+		body   string
+		expect string
+	}{
+		{"strings", `["<script>alert(0)</script>","ok"]`, `["","ok"]`},
+		{"numbers", `[1,2,3]`, `[1,2,3]`},
+		{"mixed", `[{"a":"<b>x</b>"},"<i>y</i>",1,true,null,["z"]]`, `[{"a":"x"},"y",1,true,null,["z"]]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.expect, resp.Body.String())
+		})
+	}
+}
+
+func TestXssFiltersXFormEncodedWithCharset(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	values := url.Values{}
+	values.Set("comment", `<script>alert(0)</script>ok`)
+
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "comment=ok", resp.Body.String())
+}
+
+func TestXssFiltersMalformedContentTypeParameters(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	tests := []struct {
+		contentType string
+		body        string
+		expect      string
+	}{
+		{"application/json; charset", `{"comment":"<script>alert(0)</script>ok"}`, `{"comment":"ok"}`},
+		{"application/x-www-form-urlencoded; charset", "comment=%3Cscript%3Ealert(0)%3C%2Fscript%3Eok", "comment=ok"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.expect, resp.Body.String())
+		})
+	}
+}
+
+func TestSanitizesConfiguredHeaders(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetSanitizeHeaders("x-forwarded-host", "Referer")))
+
+	req, _ := http.NewRequest("GET", "/headers", nil)
+	req.Header.Set("X-Forwarded-Host", `example.com<script>alert(0)</script>`)
+	req.Header.Set("Referer", `<img src=x onerror=alert(0)>https://example.com/`)
+	req.Header.Set("X-Custom", `<b>untouched</b>`)
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	var got http.Header
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, "example.com", got.Get("X-Forwarded-Host"))
+	assert.Equal(t, "https://example.com/", got.Get("Referer"))
+	assert.Equal(t, `<b>untouched</b>`, got.Get("X-Custom"))
+}
+
+func TestSanitizesConfiguredCookies(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetSanitizeCookies("name")))
+
+	req, _ := http.NewRequest("GET", "/headers", nil)
+	req.Header.Set("Cookie", `session=a<b>c; name=bob<img src=x onerror=alert(0)>; theme=dark`)
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	var got http.Header
+	assert.Nil(t, json.Unmarshal(resp.Body.Bytes(), &got))
+	assert.Equal(t, `session=a<b>c; name=bob; theme=dark`, got.Get("Cookie"))
+}
+
+func TestStreamingJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+		body    string
+		expect  string
+	}{
+		{"object", nil, `{"a":"<b>x</b>","b":[1,"<i>y</i>",true,null,{"c":"<s>z</s>"}],"d":{},"e":[]}`, `{"a":"x","b":[1,"y",true,null,{"c":"z"}],"d":{},"e":[]}`},
+		{"array", nil, `["<script>alert(0)</script>",[1,2],{"a":"1.50"}]`, `["",[1,2],{"a":"1.50"}]`},
+		{"scalars", nil, `"<b>x</b>"`, `"x"`},
+		{"numbers", nil, `{"a":19.99,"b":1e-7}`, `{"a":19.99,"b":1e-7}`},
+		{"entities", nil, `{"a":"A & B"}`, `{"a":"A &amp; B"}`},
+		{"skip fields", []Option{SetSkipFields("password", "user.token")}, `{"password":"<b>p</b>","user":{"token":["<i>t</i>"],"name":"<b>n</b>"}}`, `{"password":"<b>p</b>","user":{"token":["<i>t</i>"],"name":"n"}}`},
+		{"field policies", []Option{SetFieldPolicies(map[string]*bluemonday.Policy{"bio": bluemonday.UGCPolicy()})}, `{"bio":["<b>b</b>"],"name":"<b>n</b>"}`, `{"bio":["<b>b</b>"],"name":"n"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(append(tt.options, SetStreamingJSON(true))...))
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.expect, resp.Body.String())
+		})
+	}
+
+	s := newInboundServer(DefaultDefender(SetStreamingJSON(true)))
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":`))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code)
+}
+
+func benchmarkHandleJson(b *testing.B, defender *Defender) {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(`{"id":` + strconv.Itoa(i) + `,"user":"TestUser","comment":"<img src=x onerror=alert(0)>hello","tags":["a","<b>b</b>"],"active":true}`)
+	}
+	body.WriteByte(']')
+
+	b.ReportAllocs()
+	b.SetBytes(int64(body.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewReader(body.Bytes()))
+		req.Header.Add("Content-Type", "application/json")
+		if err := defender.HandleJson(&gin.Context{Request: req}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHandleJson(b *testing.B) {
+	benchmarkHandleJson(b, DefaultDefender())
+}
+
+func BenchmarkHandleJsonStreaming(b *testing.B) {
+	benchmarkHandleJson(b, DefaultDefender(SetStreamingJSON(true)))
+}
+
+func BenchmarkSanitizePlainStrings(b *testing.B) {
+	values := []string{"bob@example.com", "2021-06-01T10:00:00Z", "A perfectly ordinary sentence, with commas.", "42"}
+	policy := bluemonday.StrictPolicy()
+
+	b.Run("fast path", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, v := range values {
+				sanitizeWith(policy, v)
+			}
+		}
+	})
+	b.Run("policy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, v := range values {
+				policy.Sanitize(v)
+			}
+		}
+	})
+}
+
+func TestFastPathMatchesPolicy(t *testing.T) {
+	values := []string{"", "plain", "é ü \u2028", "a\tb\nc", "a\r\nb", "\r", "\x00\x01", "\xffab", "a=b;c%20",
+		"<b>x</b>", "a & b", "&amp;", `"q"`, "'s", "x > y", "<", "&#x3C;"}
+	for _, policy := range []*bluemonday.Policy{bluemonday.StrictPolicy(), bluemonday.UGCPolicy()} {
+		for _, v := range values {
+			assert.Equal(t, policy.Sanitize(v), sanitizeWith(policy, v), "%q", v)
+		}
+	}
+
+	// JSON strings are still escaped on the fast path
+	out, err := DefaultDefender().SanitizeJSONBytes([]byte(`["tab\there","nul\u0000","quote\"d"]`))
+	assert.NoError(t, err)
+	assert.Equal(t, `["tab\there","nul\u0000","quote&#34;d"]`, string(out))
+}
+
+func TestKeepsJsonKeyOrder(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	oParams := `{"zeta":"<b>z</b>","alpha":1,"mid":{"y":true,"b":null,"x":["<i>a</i>",{"k2":1,"k1":2}]},"beta":"b"}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `{"zeta":"z","alpha":1,"mid":{"y":true,"b":null,"x":["a",{"k2":1,"k1":2}]},"beta":"b"}`, resp.Body.String())
+
+	buff := DefaultDefender().ConstructJson(Json{"b": "1", "c": "2", "a": "3"})
+	assert.Equal(t, `{"a":"3","b":"1","c":"2"}`, buff.String())
+}
+
+func TestReportOnly(t *testing.T) {
+	type report struct{ field, before, after string }
+	var reports []report
+	s := newInboundServer(DefaultDefender(SetReportOnly(func(field, before, after string) {
+		reports = append(reports, report{field, before, after})
+	})))
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("comment", `<b>multipart</b>`)
+	_ = writer.WriteField("user", `bob`)
+	assert.Nil(t, writer.Close())
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		expect      []report
+	}{
+		{"json", "POST", "/echo", "application/json", `{"user" : "bob", "profile":{"bio":"<b>x</b>"},"tags":["<i>t</i>"]}`,
+			[]report{{"profile.bio", "<b>x</b>", "x"}, {"tags", "<i>t</i>", "t"}}},
+		{"form", "POST", "/echo", "application/x-www-form-urlencoded", `user=bob&comment=%3Cb%3Eform%3C%2Fb%3E`,
+			[]report{{"comment", "<b>form</b>", "form"}}},
+		{"multipart", "POST", "/echo", writer.FormDataContentType(), body.String(),
+			[]report{{"comment", "<b>multipart</b>", "multipart"}}},
+		{"query", "GET", "/query?user=bob&q=%3Cb%3Eq%3C%2Fb%3E", "", "",
+			[]report{{"q", "<b>q</b>", "q"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reports = nil
+			req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Add("Content-Type", tt.contentType)
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			if tt.method == "GET" {
+				assert.Equal(t, req.URL.RawQuery, resp.Body.String())
+			} else {
+				assert.Equal(t, tt.body, resp.Body.String())
+			}
+			assert.Equal(t, tt.expect, reports)
+		})
+	}
+
+	// responses aren't reported
+	reports = nil
+	r := gin.New()
+	r.Use(DefaultDefender(SetReportOnly(func(field, before, after string) {
+		reports = append(reports, report{field, before, after})
+	})).FilterXSS())
+	r.GET("/j", func(c *gin.Context) {
+		c.JSON(200, gin.H{"a": "<b>x</b>"})
+	})
+	req, _ := http.NewRequest("GET", "/j", nil)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, `{"a":"x"}`, resp.Body.String())
+	assert.Nil(t, reports)
+
+	// bodies that wouldn't be read when enforcing aren't read either, nor held to the body limit
+	for _, defender := range []*Defender{
+		DefaultDefender(SetMaxBodyBytes(10)),
+		DefaultDefender(SetMaxBodyBytes(10), SetReportOnly(func(field, before, after string) {})),
+	} {
+		s := newInboundServer(defender)
+		upload := strings.Repeat("a", 100)
+		req, _ := http.NewRequest("POST", "/echo", strings.NewReader(upload))
+		req.Header.Add("Content-Type", "application/octet-stream")
+		resp = httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, upload, resp.Body.String())
+
+		req, _ = http.NewRequest("GET", "/query?a=1", strings.NewReader(upload))
+		resp = httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code)
+	}
+}
+
+func TestSanitizeJSONBytes(t *testing.T) {
+	defender := DefaultDefender()
+
+	out, err := defender.SanitizeJSONBytes([]byte(`{"user":"<b>bob</b>","password":"<p>","ids":[1,"<i>2</i>"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"user":"bob","password":"<p>","ids":[1,"2"]}`, string(out))
+
+	out, err = defender.SanitizeJSONBytes([]byte(`[{"a":"<script>alert(0)</script>"},"<b>b</b>"]`))
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"a":""},"b"]`, string(out))
+
+	_, err = defender.SanitizeJSONBytes([]byte(`{"a":`))
+	assert.Equal(t, errNotJson, err)
+
+	_, err = defender.SanitizeJSONBytes([]byte(`{"a":1} trailing <script>alert(0)</script>`))
+	assert.Equal(t, errNotJson, err)
+
+	out, err = defender.SanitizeJSONBytes([]byte(" {\"a\":1}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a":1}`, string(out))
+}
+
+func TestRejectOnModification(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+		body    string
+		code    int
+		expect  string
+	}{
+		{"clean", []Option{SetRejectOnModification(true)}, `{"user":"bob","bio":"A and B"}`, 200, `{"user":"bob","bio":"A and B"}`},
+		{"rejected", []Option{SetRejectOnModification(true)}, `{"user":"bob","profile":{"bio":"<script>alert(0)</script>"}}`, 400, `{"msg":"field \"profile.bio\" contains disallowed markup"}`},
+		{"rejected with status", []Option{SetRejectOnModification(true, 422)}, `{"bio":"<b>b</b>"}`, 422, `{"msg":"field \"bio\" contains disallowed markup"}`},
+		{"disabled", nil, `{"bio":"<b>b</b>"}`, 200, `{"bio":"b"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(tt.options...))
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.code, resp.Code)
+			assert.JSONEq(t, tt.expect, resp.Body.String())
+		})
+	}
+}
+
+func TestMultiPartFormDataKeepsEmptyParts(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("comment", ``)
+	_ = writer.WriteField("user", `<b>bob</b>`)
+	assert.Nil(t, writer.Close())
+
+	req, _ := http.NewRequest("POST", "/echo", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	form := parseMultipart(t, resp)
+	assert.Equal(t, []string{""}, form.Value["comment"])
+	assert.Equal(t, []string{"bob"}, form.Value["user"])
+}
+
+func TestMultiPartFormDataBoundaryParameters(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	for _, contentType := range []string{
+		`multipart/form-data; boundary="----WebKitFormBoundary7MA4YWxk"`,
+		`multipart/form-data; boundary=----WebKitFormBoundary7MA4YWxk; charset=utf-8`,
+		`multipart/form-data; charset=utf-8; boundary="----WebKitFormBoundary7MA4YWxk"`,
+	} {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		assert.Nil(t, writer.SetBoundary("----WebKitFormBoundary7MA4YWxk"))
+		_ = writer.WriteField("comment", `<b>ok</b>`)
+		assert.Nil(t, writer.Close())
+
+		req, _ := http.NewRequest("POST", "/echo", body)
+		req.Header.Add("Content-Type", contentType)
+
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, contentType)
+		form := parseMultipart(t, resp)
+		assert.Equal(t, []string{"ok"}, form.Value["comment"], contentType)
+	}
+
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader("x"))
+	req.Header.Add("Content-Type", "multipart/form-data")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestMultiPartFormDataKeepsPartHeaders(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="comment"`)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("X-Custom", "kept")
+	w, _ := writer.CreatePart(header)
+	_, _ = w.Write([]byte(`<b>ok</b>`))
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="a.bin"`)
+	header.Set("Content-Transfer-Encoding", "base64")
+	w, _ = writer.CreatePart(header)
+	_, _ = w.Write([]byte(`PGI+aGk8L2I+`))
+	assert.Nil(t, writer.Close())
+
+	req, _ := http.NewRequest("POST", "/echo", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	_, params, _ := mime.ParseMediaType(resp.Header().Get("Content-Type"))
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+
+	part, err := reader.NextRawPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "kept", part.Header.Get("X-Custom"))
+	assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+	content, _ := ioutil.ReadAll(part)
+	assert.Equal(t, "ok", string(content))
+
+	part, err = reader.NextRawPart()
+	assert.Nil(t, err)
+	assert.Equal(t, "base64", part.Header.Get("Content-Transfer-Encoding"))
+	content, _ = ioutil.ReadAll(part)
+	assert.Equal(t, "PGI+aGk8L2I+", string(content))
+}
+
+func TestMultiPartFormDataDecodesQuotedPrintable(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+	s.POST("/form", func(c *gin.Context) {
+		c.String(200, c.PostForm("comment"))
+	})
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="comment"`)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	w, _ := writer.CreatePart(header)
+	_, _ = w.Write([]byte(`=3Cscript=3Ealert(1)=3C/script=3Ehi`))
+	assert.Nil(t, writer.Close())
+
+	req, _ := http.NewRequest("POST", "/form", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, "hi", resp.Body.String())
+}
+
+func TestSkipPaths(t *testing.T) {
+	oParams := `{"comment":"<b>signed</b>"}`
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{"/echo", `{"comment":"<b>signed</b>"}`},
+		{"/webhooks/github", `{"comment":"<b>signed</b>"}`},
+		{"/webhooks/stripe", `{"comment":"signed"}`},
+	}
+
+	in := newInboundServer(DefaultDefender(SetSkipPaths("/echo", "/webhooks/git*")))
+	out := newServer(DefaultDefender(SetSkipPaths("/user_post_nested_json")))
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", tt.path, bytes.NewBufferString(oParams))
+		req.Header.Add("Content-Type", "application/json")
+
+		resp := httptest.NewRecorder()
+		in.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, tt.path)
+		assert.Equal(t, tt.expect, resp.Body.String(), tt.path)
+	}
+
+	oParams = `{"id":1,"users":[{"id":2,"user":"<b>bob</b>"}]}`
+	req, _ := http.NewRequest("POST", "/user_post_nested_json", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	out.ServeHTTP(resp, req)
+
+	assert.Equal(t, 201, resp.Code)
+	assert.Contains(t, resp.Body.String(), `\u003cb\u003ebob\u003c/b\u003e`)
+}
+
+func TestSkipFieldPatterns(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetSkipFieldPatterns("*_html", "raw?")))
+
+	oParams := `{"body_html":"<b>b</b>","title":"<b>t</b>","nested":{"note_html":"<i>n</i>"},"raw1":"<p>r</p>","raw12":"<p>r</p>"}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.JSONEq(t, `{"body_html":"<b>b</b>","title":"t","nested":{"note_html":"<i>n</i>"},"raw1":"<p>r</p>","raw12":"r"}`, resp.Body.String())
+
+	req, _ = http.NewRequest("GET", "/query?body_html=%3Cb%3Eb%3C%2Fb%3E&title=%3Cb%3Et%3C%2Fb%3E", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	query, _ := url.ParseQuery(resp.Body.String())
+	assert.Equal(t, "<b>b</b>", query.Get("body_html"))
+	assert.Equal(t, "t", query.Get("title"))
+}
+
+func TestKeepsJsonNulls(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"top level", `null`},
+		{"skipped", `{"x":null,"y":"a"}`},
+		{"nested", `{"a":{"x":null,"b":[null,{"x":null}]}}`},
+	}
+
+	s := newInboundServer(DefaultDefender(SetSkipFields("x")))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.body, resp.Body.String())
+		})
+	}
+}
+
+func TestSkipFieldsKeepTheirType(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetSkipFields("config", "ids", "count", "flag", "note")))
+
+	oParams := `{"config":{"b":1,"a":"<b>x</b>","c":[true,null]},"ids":[1,"<i>2</i>",{"k":"v"}],"count":1.50,"flag":false,"note":"<b>n</b>","other":"<b>o</b>"}`
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(oParams))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `{"config":{"b":1,"a":"<b>x</b>","c":[true,null]},"ids":[1,"<i>2</i>",{"k":"v"}],"count":1.50,"flag":false,"note":"<b>n</b>","other":"o"}`, resp.Body.String())
+}
+
+type fakeLogger struct {
+	debug []string
+	info  []string
+}
+
+func (l *fakeLogger) Debugf(format string, args ...interface{}) {
+	l.debug = append(l.debug, fmt.Sprintf(format, args...))
+}
+
+func (l *fakeLogger) Infof(format string, args ...interface{}) {
+	l.info = append(l.info, fmt.Sprintf(format, args...))
+}
+
+func TestSkipEmptyValues(t *testing.T) {
+	fill := SetFieldTransform("b", func(v string) string {
+		if v == "" {
+			return "n/a"
+		}
+		return v
+	})
+	tests := []struct {
+		name      string
+		skip      bool
+		json      string
+		form      string
+		query     string
+		inspected []int
+	}{
+		{"default", false, `{"a":"","b":"n/a","c":"x"}`, "a=&b=n%2Fa&c=x", "a=&b=n%2Fa&c=x&d", []int{3, 3, 4}},
+		{"skip", true, `{"a":"","b":"","c":"x"}`, "a=&b=&c=x", "a=&b=&c=x&d", []int{1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inspected []int
+			s := newInboundServer(DefaultDefender(fill, SetSkipEmptyValues(tt.skip), SetMetrics(func(m Metrics) {
+				inspected = append(inspected, m.FieldsInspected)
+			})))
+
+			req, _ := http.NewRequest("POST", "/echo", strings.NewReader(`{"a":"","b":"","c":"<b>x</b>"}`))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.json, resp.Body.String())
+
+			req, _ = http.NewRequest("POST", "/echo", strings.NewReader("a=&b=&c=%3Cb%3Ex%3C%2Fb%3E"))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.form, resp.Body.String())
+
+			req, _ = http.NewRequest("GET", "/query?a=&b=&c=%3Cb%3Ex%3C%2Fb%3E&d", nil)
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.query, resp.Body.String())
+
+			assert.Equal(t, tt.inspected, inspected)
+		})
+	}
+}
+
+func TestUnicodeNormalization(t *testing.T) {
+	tests := []struct {
+		name  string
+		form  norm.Form
+		value string
+		want  string
+	}{
+		{"off", -1, "\uff1cscript\uff1ealert(1)\uff1c/script\uff1e", "\uff1cscript\uff1ealert(1)\uff1c/script\uff1e"},
+		{"fullwidth brackets", norm.NFKC, "\uff1cscript\uff1ealert(1)\uff1c/script\uff1ex", "x"},
+		{"small less-than", norm.NFKC, "\ufe64b\ufe65bold", "bold"},
+		{"ligature", norm.NFKD, "\ufb01le", "file"},
+		{"decomposed", norm.NFKD, "caf\u00e9", "cafe\u0301"},
+		{"composed", norm.NFC, "cafe\u0301", "caf\u00e9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := []Option{}
+			if tt.form >= 0 {
+				options = append(options, SetUnicodeNormalization(tt.form))
+			}
+			got := DefaultDefender(options...).SanitizeValues(url.Values{"a": {tt.value}})
+			assert.Equal(t, tt.want, got.Get("a"))
+		})
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	deep := `{"a":{"b":{"c":"<b>x</b>"}}}`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(deep))
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		encoding string
+		body     []byte
+		code     int
+		want     string
+	}{
+		{"closed", false, "", []byte(deep), 400, `{"msg":"xss json: json nested too deeply"}`},
+		{"open", true, "", []byte(deep), 200, deep},
+		{"open compressed", true, "gzip", gz.Bytes(), 200, gz.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &fakeLogger{}
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(DefaultDefender(SetMaxJSONDepth(2), SetFailOpen(tt.failOpen), SetLogger(logger)).RemoveXSS())
+			r.POST("/echo", func(c *gin.Context) {
+				body, _ := ioutil.ReadAll(c.Request.Body)
+				assert.Equal(t, tt.encoding, c.GetHeader("Content-Encoding"))
+				assert.Equal(t, strconv.Itoa(len(tt.body)), c.GetHeader("Content-Length"))
+				c.Data(200, "application/json", body)
+			})
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewReader(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+			if tt.encoding != "" {
+				req.Header.Add("Content-Encoding", tt.encoding)
+			}
+			req.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.code, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+			assert.Len(t, logger.info, 1)
+		})
+	}
+
+	// markup found is still rejected
+	s := newInboundServer(DefaultDefender(SetFailOpen(true), SetRejectOnModification(true)))
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader(`{"a":"<b>x</b>"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+}
+
+func TestLogsChangedFields(t *testing.T) {
+	logger := &fakeLogger{}
+	s := newInboundServer(DefaultDefender(SetLogger(logger)))
+
+	for _, body := range []string{`{"a":"<b>x</b>","b":"y","c":{"d":"<i>z</i>"}}`, `{"a":"clean"}`} {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code)
+	}
+
+	assert.Equal(t, []string{"xss: POST /echo, fields changed: a, c.d"}, logger.debug)
+	assert.Empty(t, logger.info)
+}
+
+func TestLogsRejectedRequests(t *testing.T) {
+	logger := &fakeLogger{}
+	s := newInboundServer(DefaultDefender(SetLogger(logger), SetRejectOnModification(true)))
+
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":"<b>x</b>"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 400, resp.Code)
+	assert.Equal(t, []string{`xss: POST /echo rejected, field "a" contains disallowed markup`}, logger.info)
+}
+
+func TestMetricsCountFields(t *testing.T) {
+	var got []Metrics
+	s := newInboundServer(DefaultDefender(SetMetrics(func(m Metrics) {
+		got = append(got, m)
+	})))
+
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":"<b>x</b>","b":"y","c":["<i>z</i>",1],"password":"<p>"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+
+	req, _ = http.NewRequest("GET", "/query?q=clean", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+
+	assert.Equal(t, []Metrics{
+		{FieldsInspected: 3, FieldsModified: 2, BytesIn: 17, BytesOut: 3},
+		{FieldsInspected: 1, FieldsModified: 0, BytesIn: 5, BytesOut: 5},
+	}, got)
+}
+
+func TestQueryKeepsOrderAndEncoding(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"b=1&a=2&c=3", "b=1&a=2&c=3"},
+		{"z=%3Cb%3Ex%3C%2Fb%3E&a=2", "z=x&a=2"},
+		{"sig=a%2Fb%2bc&q=two+words&flag", "sig=a%2Fb%2bc&q=two+words&flag"},
+		{"password=%3Cp%3E&b=%3Ci%3E", "password=%3Cp%3E&b="},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/query?"+tt.query, nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.query)
+	}
+}
+
+func TestSkipURLFields(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetSkipURLFields("link", "profile.site")))
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"link":"https://example.com/search?q=x&a=b"}`, `{"link":"https://example.com/search?q=x&a=b"}`},
+		{`{"link":"/relative/path?a=1&b=2"}`, `{"link":"/relative/path?a=1&b=2"}`},
+		{`{"link":"javascript:alert(1)"}`, `{"link":""}`},
+		{`{"link":"JavaScript:alert(1)"}`, `{"link":""}`},
+		{`{"link":"http://[::1"}`, `{"link":""}`},
+		{`{"link":"<script>alert(1)</script>"}`, `{"link":""}`},
+		{`{"link":"https://example.com/\"><script>alert(1)</script>"}`, `{"link":""}`},
+		{`{"link":"https://example.com/a b"}`, `{"link":""}`},
+		{`{"links":{"link":["https://a.example/?x=1&y=2","javascript:x"]}}`, `{"links":{"link":["https://a.example/?x=1&y=2",""]}}`},
+		{`{"profile":{"site":"https://me.example/?a=b&c=d"},"site":"https://me.example/?a=b&c=d"}`, `{"profile":{"site":"https://me.example/?a=b&c=d"},"site":"https://me.example/?a=b&amp;c=d"}`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.body)
+	}
+}
+
+func TestQueryAllowlist(t *testing.T) {
+	query := "q=%3Cb%3Ex%3C%2Fb%3E&search=%3Ci%3Ey%3C%2Fi%3E&sort=%3Cu%3Ename%3C%2Fu%3E&q=z"
+	tests := []struct {
+		name     string
+		defender *Defender
+		want     string
+	}{
+		{"all", DefaultDefender(), "q=x&search=y&sort=name&q=z"},
+		{"allowlist", DefaultDefender(SetQueryAllowlist("q", "search")), "q=x&search=y&sort=%3Cu%3Ename%3C%2Fu%3E&q=z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(tt.defender)
+			req, _ := http.NewRequest("GET", "/query?"+query, nil)
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+
+	// form bodies are sanitized whole
+	s := newInboundServer(DefaultDefender(SetQueryAllowlist("q")))
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader("sort=%3Cu%3Ename%3C%2Fu%3E"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, "sort=name", resp.Body.String())
+}
+
+func TestDuplicateKeyPolicy(t *testing.T) {
+	body := `{"a":"x","b":{"c":1,"c":"<i>2</i>"},"a":"<script>alert(1)</script>y"}`
+	tests := []struct {
+		name       string
+		duplicates DuplicateKeyPolicy
+		code       int
+		want       string
+	}{
+		{"all", KeepAllKeys, 200, `{"a":"x","b":{"c":1,"c":"2"},"a":"y"}`},
+		{"first", KeepFirstKey, 200, `{"a":"x","b":{"c":1}}`},
+		{"last", KeepLastKey, 200, `{"a":"y","b":{"c":"2"}}`},
+		{"reject", RejectDuplicateKeys, 400, `{"msg":"xss json field \"c\": duplicate json key"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(SetDuplicateKeyPolicy(tt.duplicates)))
+			req, _ := http.NewRequest("POST", "/echo", strings.NewReader(body))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.code, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+}
+
+func TestStripFields(t *testing.T) {
+	d := NewDefender(bluemonday.UGCPolicy(), SetStripFields("price", "item.qty"))
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"price":"<b>123</b>","note":"<b>123</b>"}`, `{"price":"123","note":"<b>123</b>"}`},
+		{`{"price":"1 < 2 & \"3\"","note":"1 < 2"}`, `{"price":"1  2  3","note":"1 &lt; 2"}`},
+		{`{"item":{"qty":"<i>4</i>","price":"<script>x</script>5"},"qty":"<i>4</i>"}`, `{"item":{"qty":"4","price":"5"},"qty":"<i>4</i>"}`},
+	}
+	for _, tt := range tests {
+		out, err := d.SanitizeJSONBytes([]byte(tt.body))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, string(out), tt.body)
+	}
+
+	form := d.SanitizeValues(url.Values{"price": {"<b>1&amp;2</b>"}, "note": {"a & b"}})
+	assert.Equal(t, "12", form.Get("price"))
+	assert.Equal(t, "a &amp; b", form.Get("note"))
+}
+
+func TestResponseNestedArrays(t *testing.T) {
+	s := newServer(DefaultDefender())
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"matrix":[[1,2],[3,4]]}`, `{"matrix":[[1,2],[3,4]]}`},
+		{`{"cells":[["<b>a</b>","b"],[[],["<script>x</script>c",null,true,1.5]]]}`, `{"cells":[["a","b"],[[],["c",null,true,1.5]]]}`},
+		{`[[{"name":"<i>bob</i>","tags":[["<u>t</u>"]]}]]`, `[[{"name":"bob","tags":[["t"]]}]]`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/response_json", strings.NewReader(tt.body))
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.body)
+	}
+}
+
+func TestResponseBufferLimit(t *testing.T) {
+	chunks := []string{`{"a":"<b>x</b>",`, `"b":"` + strings.Repeat("y", 32) + `",`, `"c":"<i>z</i>"}`}
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+		logged int
+	}{
+		{"under the limit", []string{`{"a":"<b>x</b>"}`}, `{"a":"x"}`, 0},
+		{"over the limit", chunks, strings.Join(chunks, ""), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &fakeLogger{}
+			resp := httptest.NewRecorder()
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(DefaultDefender(SetResponseBufferLimit(32), SetLogger(logger)).FilterXSS())
+			r.GET("/export", func(c *gin.Context) {
+				c.Header("Content-Type", "application/json")
+				c.Status(201)
+				for i, chunk := range tt.chunks {
+					c.Writer.WriteString(chunk)
+					if i == 1 {
+						assert.NotZero(t, resp.Body.Len(), "streamed while the handler writes")
+					}
+				}
+			})
+
+			req, _ := http.NewRequest("GET", "/export", nil)
+			r.ServeHTTP(resp, req)
+
+			assert.Equal(t, 201, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+			assert.Len(t, logger.info, tt.logged)
+		})
+	}
+}
+
+func TestSanitizeResponseHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(DefaultDefender(SetSanitizeResponseHeaders("location")).FilterXSS())
+	r.GET("/redirect", func(c *gin.Context) {
+		c.Header("Location", c.Query("to"))
+		c.Header("X-To", c.Query("to"))
+		c.Status(302)
+	})
+
+	tests := []struct {
+		name string
+		to   string
+		want []string
+	}{
+		{"https", "https://example.com/a?b=c&d=e", []string{"https://example.com/a?b=c&d=e"}},
+		{"relative", "/next", []string{"/next"}},
+		{"javascript", "javascript:alert(1)", nil},
+		{"hidden scheme", "java\tscript:alert(1)", nil},
+		{"crlf", "/next\r\nSet-Cookie: a=b", nil},
+		{"markup", `/next"><script>alert(1)</script>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/redirect?to="+url.QueryEscape(tt.to), nil)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			assert.Equal(t, 302, resp.Code)
+			assert.Equal(t, tt.want, resp.Header().Values("Location"))
+			assert.Equal(t, tt.to, resp.Header().Get("X-To"), "other headers are left alone")
+		})
+	}
+
+	r = gin.New()
+	r.Use(DefaultDefender(SetSanitizeResponseHeaders("refresh")).FilterXSS())
+	r.GET("/refresh", func(c *gin.Context) {
+		c.Header("Refresh", c.Query("to"))
+		c.Status(200)
+	})
+	refreshes := []struct {
+		to   string
+		want []string
+	}{
+		{"0; url=https://example.com/", []string{"0; url=https://example.com/"}},
+		{"0;url=https://example.com/", []string{"0; url=https://example.com/"}},
+		{"5; URL='/next?a=b'", []string{"5; url=/next?a=b"}},
+		{"10", []string{"10"}},
+		{"0; url=javascript:alert(1)", nil},
+		{"0;url=javascript:alert(1)", nil},
+		{"javascript:alert(1)", nil},
+	}
+	for _, tt := range refreshes {
+		req, _ := http.NewRequest("GET", "/refresh?to="+url.QueryEscape(tt.to), nil)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		assert.Equal(t, tt.want, resp.Header().Values("Refresh"), tt.to)
+	}
+}
+
+func TestSanitizeStruct(t *testing.T) {
+	type Address struct {
+		Street string `json:"street"`
+		City   *string
+	}
+	type Meta struct {
+		Source string
+	}
+	type User struct {
+		Meta
+		Name     string            `json:"name"`
+		Password string            `json:"password"`
+		Raw      string            `xss:"skip"`
+		Tags     []string          `json:"tags"`
+		Address  Address           `json:"address"`
+		Previous []*Address        `json:"previous"`
+		Labels   map[string]string `json:"labels"`
+		Extra    interface{}       `json:"extra"`
+		Age      int
+		secret   string
+		Self     *User
+	}
+	city := "<b>Paris</b>"
+	u := User{
+		Meta:     Meta{Source: "<i>web</i>"},
+		Name:     "<script>alert(1)</script>bob",
+		Password: "<p>pw",
+		Raw:      "<b>raw</b>",
+		Tags:     []string{"<b>a</b>", "b"},
+		Address:  Address{Street: "<u>Main</u> st", City: &city},
+		Previous: []*Address{{Street: "<i>Old</i> st"}, nil},
+		Labels:   map[string]string{"k": "<b>v</b>"},
+		Extra:    "<b>x</b>",
+		Age:      3,
+		secret:   "<b>s</b>",
+	}
+	u.Self = &u
+
+	assert.NoError(t, DefaultDefender().SanitizeStruct(&u))
+	assert.Equal(t, "web", u.Source)
+	assert.Equal(t, "bob", u.Name)
+	assert.Equal(t, "<p>pw", u.Password, "skip fields apply")
+	assert.Equal(t, "<b>raw</b>", u.Raw)
+	assert.Equal(t, []string{"a", "b"}, u.Tags)
+	assert.Equal(t, "Main st", u.Address.Street)
+	assert.Equal(t, "Paris", city)
+	assert.Equal(t, "Old st", u.Previous[0].Street)
+	assert.Equal(t, map[string]string{"k": "v"}, u.Labels)
+	assert.Equal(t, "x", u.Extra)
+	assert.Equal(t, "<b>s</b>", u.secret, "unexported fields are left alone")
+
+	assert.Error(t, DefaultDefender().SanitizeStruct(u))
+	assert.Error(t, DefaultDefender().SanitizeStruct((*User)(nil)))
+}
+
+func TestSanitizeStructTagPolicies(t *testing.T) {
+	type Profile struct {
+		Name    string
+		Bio     string   `xss:"ugc"`
+		Notes   []string `xss:"ugc"`
+		Snippet string   `xss:"none"`
+		Motto   string   `xss:"loud"`
+	}
+	p := Profile{
+		Name:    "<b>bob</b>",
+		Bio:     "<b>hi</b><script>alert(1)</script>",
+		Notes:   []string{"<i>a</i>", "<img src=x onerror=alert(1)>"},
+		Snippet: "<b>raw</b>",
+		Motto:   "<b>hey</b>",
+	}
+	loud := bluemonday.NewPolicy()
+	loud.AllowElements("b")
+	assert.NoError(t, DefaultDefender(SetTagPolicy("loud", loud)).SanitizeStruct(&p))
+	assert.Equal(t, Profile{
+		Name:    "bob",
+		Bio:     "<b>hi</b>",
+		Notes:   []string{"<i>a</i>", `<img src="x">`},
+		Snippet: "<b>raw</b>",
+		Motto:   "<b>hey</b>",
+	}, p)
+
+	err := DefaultDefender().SanitizeStruct(&Profile{Motto: "x"})
+	var xssErr *XSSError
+	assert.True(t, errors.As(err, &xssErr))
+	assert.Equal(t, "Motto", xssErr.Field)
+	assert.EqualError(t, err, `xss struct field "Motto": unknown policy "loud"`)
+}
+
+func TestSanitizeStructAfterBinding(t *testing.T) {
+	type Comment struct {
+		Body string `json:"body" binding:"required"`
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	d := DefaultDefender()
+	r.POST("/comments", func(c *gin.Context) {
+		var comment Comment
+		if err := c.ShouldBindJSON(&comment); err != nil || d.SanitizeStruct(&comment) != nil {
+			c.Status(400)
+			return
+		}
+		c.String(200, comment.Body)
+	})
+
+	req, _ := http.NewRequest("POST", "/comments", strings.NewReader(`{"body":"hi<script>x</script>"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, "hi", resp.Body.String())
+}
+
+func TestPolicy(t *testing.T) {
+	strict := bluemonday.StrictPolicy()
+	d := NewDefender(strict)
+	assert.Same(t, strict, d.Policy())
+	assert.Same(t, IdentityPolicy(), NewDefender(IdentityPolicy()).Policy())
+
+	d.Policy().AllowElements("b")
+	assert.Equal(t, "<b>x</b>y", d.Policy().Sanitize("<b>x</b><i>y</i>"))
+	out, err := d.SanitizeJSONBytes([]byte(`{"a":"<b>x</b><i>y</i>"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"<b>x</b>y"}`, string(out))
+}
+
+func TestClone(t *testing.T) {
+	fields := make([]string, 1, 4)
+	fields[0] = "password"
+	parent := DefaultDefender(SetSkipFields(fields...), SetFieldTransform("id", strings.TrimSpace))
+	child := parent.Clone(func(d *Defender) {
+		d.skipFields = append(d.skipFields, "token")
+	}, SetFieldTransform("name", strings.ToUpper), SetPolicy(bluemonday.UGCPolicy()))
+
+	assert.Equal(t, []string{"password"}, parent.skipFields)
+	assert.Equal(t, "", fields[:2][1], "the slice given to the parent is left alone")
+	assert.Equal(t, []string{"password", "token"}, child.skipFields)
+	assert.Len(t, parent.fieldTransforms, 1)
+
+	body := `{"id":" 1 ","name":"<b>bob</b>","token":"<i>t</i>","password":"<p>"}`
+	send := func(d *Defender) string {
+		req, _ := http.NewRequest("POST", "/echo", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		newInboundServer(d).ServeHTTP(resp, req)
+		return resp.Body.String()
+	}
+	assert.Equal(t, `{"id":"1","name":"bob","token":"t","password":"<p>"}`, send(parent))
+	assert.Equal(t, `{"id":"1","name":"<b>BOB</b>","token":"<i>t</i>","password":"<p>"}`, send(child))
+
+	// the shared policy can't take URL schemes nor configurers of the clone, one of its own can
+	assert.Panics(t, func() { parent.Clone(SetAllowedURLSchemes("https")) })
+	assert.Panics(t, func() { parent.Clone(SetPolicyConfigurer(func(p *bluemonday.Policy) { p.AllowComments() })) })
+	ugc := parent.Clone(SetPolicy(bluemonday.UGCPolicy()), SetPolicyConfigurer(func(p *bluemonday.Policy) { p.AllowComments() }))
+	assert.Equal(t, "<!-- x -->", ugc.policy.Sanitize("<!-- x -->"))
+	assert.Equal(t, "", parent.policy.Sanitize("<!-- x -->"))
+}
+
+func TestDataURIFields(t *testing.T) {
+	png := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	s := newInboundServer(DefaultDefender(SetDataURIFields("avatar")))
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"png", png, png},
+		{"empty", "", ""},
+		{"html", "data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", ""},
+		{"svg", "data:image/svg+xml;base64,PHN2Zz48L3N2Zz4=", ""},
+		{"not base64", "data:image/png,<script>alert(1)</script>", ""},
+		{"bad payload", "data:image/png;base64,<script>", ""},
+		{"not a data uri", "javascript:alert(1)", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{"avatar": tt.value, "name": "<b>bob</b>"})
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewReader(body))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			var got map[string]string
+			assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+			assert.Equal(t, map[string]string{"avatar": tt.want, "name": "bob"}, got)
+		})
+	}
+}
+
+func TestJsonDocumentShapes(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"string", `"<a>x</a>"`, `"x"`},
+		{"number", `12.50`, `12.50`},
+		{"bool", `true`, `true`},
+		{"null", `null`, `null`},
+		{"empty array", `[]`, `[]`},
+		{"array of scalars", `["<a>","b",1,false,null]`, `["","b",1,false,null]`},
+		{"array of arrays", `[["<i>a</i>",[]],[["b"]]]`, `[["a",[]],[["b"]]]`},
+		{"array of objects", `[{"a":"<b>x</b>"},{}]`, `[{"a":"x"},{}]`},
+		{"empty object", `{}`, `{}`},
+		{"object", `{"b":["<p>1</p>",{"c":2}],"a":"x"}`, `{"b":["1",{"c":2}],"a":"x"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+
+			// a sanitized document sanitizes to itself
+			again, err := DefaultDefender().SanitizeJSONBytes([]byte(tt.want))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(again))
+		})
+	}
+}
+
+func TestPreserveFormatting(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"compact", `{"a":"<b>x</b>","b":[1,2]}`, `{"a":"x","b":[1,2]}`},
+		{"two spaces", "{\n  \"a\": \"<b>x</b>\",\n  \"b\": [\n    1\n  ]\n}\n", "{\n  \"a\": \"x\",\n  \"b\": [\n    1\n  ]\n}\n"},
+		{"tabs", "[\n\t{\n\t\t\"a\": \"<i>y</i>\"\n\t}\n]", "[\n\t{\n\t\t\"a\": \"y\"\n\t}\n]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(SetPreserveFormatting(true)))
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+
+	// compacted unless asked otherwise
+	s := newInboundServer(DefaultDefender())
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString("{\n  \"a\": \"x\"\n}"))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, `{"a":"x"}`, resp.Body.String())
+}
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/users/bob%3Cimg%20src=x%20onerror=alert(1)%3E/profile", `{"name":"bob","path":"/users/bob/profile","raw":"/users/bob/profile"}`},
+		{"/users/bob%3Cscript%3Ealert(1)%3C%5Cscript%3E/profile", `{"name":"bob","path":"/users/bob/profile","raw":"/users/bob/profile"}`},
+		{"/users/a%20b/profile", `{"name":"a b","path":"/users/a b/profile","raw":"/users/a%20b/profile"}`},
+	}
+	for _, tt := range tests {
+		s := newInboundServer(DefaultDefender(SetSanitizePath(true)))
+
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, tt.path)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.path)
+	}
+
+	// untouched unless asked for
+	s := newInboundServer(DefaultDefender())
+	req, _ := http.NewRequest("GET", "/users/bob%3Cb%3E/profile", nil)
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, `{"name":"bob\u003cb\u003e","path":"/users/bob\u003cb\u003e/profile","raw":"/users/bob%3Cb%3E/profile"}`, resp.Body.String())
+
+	// parameters go through the same steps as the path, entity encoding included
+	s = newInboundServer(DefaultDefender(SetSanitizePath(true), SetEntityEncoding(StripEntities)))
+	req, _ = http.NewRequest("GET", "/users/tom%26jerry/profile", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, `{"name":"tomjerry","path":"/users/tomjerry/profile","raw":"/users/tomjerry/profile"}`, resp.Body.String())
+
+	// reported under "path", and left as it was
+	var reported []string
+	s = newInboundServer(DefaultDefender(SetSanitizePath(true), SetReportOnly(func(field, before, after string) {
+		reported = append(reported, field)
+	})))
+	req, _ = http.NewRequest("GET", "/users/bob%3Cb%3E/profile", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, `{"name":"bob\u003cb\u003e","path":"/users/bob\u003cb\u003e/profile","raw":"/users/bob%3Cb%3E/profile"}`, resp.Body.String())
+	assert.Equal(t, []string{"path"}, reported)
+}
+
+func TestNoDoubleEscaping(t *testing.T) {
+	defender := DefaultDefender()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(defender.RemoveXSS(), defender.FilterXSS())
+	g := r.Group("/", defender.RemoveXSS(), defender.FilterXSS())
+	g.POST("/echo", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.Data(200, "application/json", body)
+	})
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"a":"a & b"}`, `{"a":"a &amp; b"}`},
+		{`{"a":"a &amp; b"}`, `{"a":"a &amp; b"}`},
+		{`{"a":"<b>x</b> < y"}`, `{"a":"x &lt; y"}`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.body)
+	}
+
+	for _, policy := range []*bluemonday.Policy{bluemonday.StrictPolicy(), bluemonday.UGCPolicy()} {
+		for _, value := range []string{"a & b", `<b>x</b> & "q" <`, "&lt;script&gt;"} {
+			once := policy.Sanitize(value)
+			assert.Equal(t, once, policy.Sanitize(once), value)
+		}
+	}
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	nested := strings.Repeat(`{"a":[`, 50000) + `"<b>x</b>"` + strings.Repeat(`]}`, 50000)
+
+	for _, streaming := range []bool{false, true} {
+		s := newInboundServer(DefaultDefender(SetMaxJSONDepth(4), SetStreamingJSON(streaming)))
+
+		tests := []struct {
+			body string
+			code int
+		}{
+			{`{"a":[{"b":["<i>x</i>"]}]}`, 200},
+			{`{"a":[{"b":[{}]}]}`, 400},
+			{nested, 400},
+		}
+		for _, tt := range tests {
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.code, resp.Code, "streaming %v", streaming)
+		}
+	}
+
+	_, err := DefaultDefender(SetMaxJSONDepth(2)).SanitizeJSONBytes([]byte(`[[[1]]]`))
+	assert.Equal(t, errTooDeep, err)
+}
+
+func TestSanitizedBodyCanBeReadAgain(t *testing.T) {
+	defender := DefaultDefender()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(defender.RemoveXSS())
+	r.POST("/twice", func(c *gin.Context) {
+		var first, second struct {
+			A string `json:"a"`
+		}
+		assert.NoError(t, c.ShouldBindBodyWith(&first, binding.JSON))
+		assert.NoError(t, c.ShouldBindBodyWith(&second, binding.JSON))
+		c.String(200, first.A+"|"+second.A+"|"+string(defender.SanitizedBody(c)))
+	})
+	r.GET("/twice", func(c *gin.Context) {
+		c.String(200, "%v", defender.SanitizedBody(c) == nil)
+	})
+
+	req, _ := http.NewRequest("POST", "/twice", bytes.NewBufferString(`{"a":"<b>x</b>y"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `xy|xy|{"a":"xy"}`, resp.Body.String())
+
+	req, _ = http.NewRequest("GET", "/twice?a=b", nil)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, "true", resp.Body.String())
+}
+
+func TestNdjson(t *testing.T) {
+	body := "{\"id\":1,\"msg\":\"hi\"}\n" +
+		"{\"id\":2,\"msg\":\"<script>alert(1)</script>bye\"}\r\n" +
+		"\n" +
+		"[\"<b>x</b>\",{\"password\":\"<p>\"}]\n" +
+		"not json <b>\n" +
+		"{\"id\":3}"
+	want := "{\"id\":1,\"msg\":\"hi\"}\n" +
+		"{\"id\":2,\"msg\":\"bye\"}\r\n" +
+		"\n" +
+		"[\"x\",{\"password\":\"<p>\"}]\n" +
+		"not json <b>\n" +
+		"{\"id\":3}"
+
+	s := newInboundServer(DefaultDefender())
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, want, resp.Body.String())
+	assert.Equal(t, strings.Count(body, "\n"), strings.Count(resp.Body.String(), "\n"))
+}
+
+func TestHandleXML(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetHandleXML(true), SetSkipFields("order.raw")))
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			"application/xml",
+			`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<order id="&lt;b&gt;7&lt;/b&gt;"><note>hi &lt;script&gt;alert(1)&lt;/script&gt;there</note><raw>&lt;b&gt;x&lt;/b&gt;</raw><!-- c --></order>`,
+			`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<order id="7"><note>hi there</note><raw>&lt;b&gt;x&lt;/b&gt;</raw><!-- c --></order>`,
+		},
+		{
+			"text/xml; charset=utf-8",
+			"<soap:Envelope xmlns:soap=\"http://schemas.xmlsoap.org/soap/envelope/\">\n  <soap:Body><![CDATA[<i>x</i> & y]]></soap:Body>\n</soap:Envelope>",
+			"<soap:Envelope xmlns:soap=\"http://schemas.xmlsoap.org/soap/envelope/\">\n  <soap:Body>x &amp;amp; y</soap:Body>\n</soap:Envelope>",
+		},
+		{"application/xml", `<a><b>unclosed</a>`, `<a><b>unclosed</a>`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+		req.Header.Add("Content-Type", tt.contentType)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String())
+	}
+
+	// what the decoder can't read, lenient parsers could, it is refused rather than passed on unsanitized
+	for _, body := range []string{
+		`<?xml version="1.0" encoding="ISO-8859-1"?><a>&lt;script&gt;alert(1)&lt;/script&gt;</a>`,
+		`<a>&nbsp;&lt;script&gt;alert(1)&lt;/script&gt;</a>`,
+	} {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/xml")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 400, resp.Code, body)
+		assert.NotContains(t, resp.Body.String(), "script&gt;alert", body)
+	}
+
+	// left alone unless asked for
+	s = newInboundServer(DefaultDefender())
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`<a>&lt;b&gt;</a>`))
+	req.Header.Add("Content-Type", "application/xml")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, `<a>&lt;b&gt;</a>`, resp.Body.String())
+}
+
+func TestFilterXSSOnArraysAndScalars(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := newServer(DefaultDefender())
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"array of strings", `["<b>x</b>","y"]`, `["x","y"]`},
+		{"array of arrays", `[["<i>a</i>"],[]]`, `[["a"],[]]`},
+		{"array of objects", `[{"a":"<b>x</b>"},{"password":"<p>"}]`, `[{"a":"x"},{"password":"<p>"}]`},
+		{"string", `"<script>alert(0)</script>ok"`, `"ok"`},
+		{"number", `42`, `42`},
+		{"bool", `false`, `false`},
+		{"null", `null`, `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/response_json", bytes.NewBufferString(tt.body))
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+			assert.Equal(t, strconv.Itoa(len(tt.want)), resp.Header().Get("Content-Length"))
+		})
+	}
+}
+
+func TestOptOutHeader(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetOptOutHeader("X-Skip-XSS", "10.0.0.0/8", "192.168.1.5")))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{"trusted range", "10.1.2.3:4567", "1", `{"a":"<b>x</b>"}`},
+		{"trusted address", "192.168.1.5:80", "1", `{"a":"<b>x</b>"}`},
+		{"untrusted address", "192.168.1.6:80", "1", `{"a":"x"}`},
+		{"untrusted public address", "203.0.113.9:80", "1", `{"a":"x"}`},
+		{"trusted without header", "10.1.2.3:4567", "", `{"a":"x"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":"<b>x</b>"}`))
+			req.Header.Add("Content-Type", "application/json")
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("X-Skip-XSS", tt.header)
+			}
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+}
+
+func TestOptOutContextKey(t *testing.T) {
+	defender := DefaultDefender()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "internal" {
+			c.Set(SkipContextKey, true)
+		}
+	}, defender.RemoveXSS(), defender.FilterXSS())
+	r.POST("/echo", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.Data(200, "application/json", append(body[:len(body)-1], []byte(`,"out":"<i>y</i>"}`)...))
+	})
+
+	for _, auth := range []string{"internal", "other"} {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":"<b>x</b>"}`))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Set("Authorization", auth)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		if auth == "internal" {
+			assert.Equal(t, `{"a":"<b>x</b>","out":"<i>y</i>"}`, resp.Body.String())
+		} else {
+			assert.Equal(t, `{"a":"x","out":"y"}`, resp.Body.String())
+		}
+	}
+}
+
+func TestSanitizeFileParts(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><text>hi</text></svg>`
+	upload := func() (*bytes.Buffer, string) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="icon"; filename="icon.svg"`)
+		h.Set("Content-Type", "image/svg+xml")
+		part, _ := writer.CreatePart(h)
+		part.Write([]byte(svg))
+		file, _ := writer.CreateFormFile("photo", "photo.png")
+		file.Write([]byte("<binary>"))
+		assert.Nil(t, writer.Close())
+		return body, writer.FormDataContentType()
+	}
+
+	tests := []struct {
+		name     string
+		defender *Defender
+		icon     string
+	}{
+		{"default", DefaultDefender(), svg},
+		{"svg sanitized", DefaultDefender(SetSanitizeFileParts(func(filename, contentType string) bool {
+			return contentType == "image/svg+xml"
+		})), "hi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(tt.defender)
+			body, contentType := upload()
+			req, _ := http.NewRequest("POST", "/echo", body)
+			req.Header.Add("Content-Type", contentType)
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			form := parseMultipart(t, resp)
+			for name, want := range map[string]string{"icon": tt.icon, "photo": "<binary>"} {
+				f, err := form.File[name][0].Open()
+				assert.Nil(t, err)
+				got, _ := ioutil.ReadAll(f)
+				assert.Equal(t, want, string(got), name)
+			}
+		})
+	}
+}
+
+func TestSanitizeValues(t *testing.T) {
+	in := url.Values{
+		"tag":      {"<b>a</b>", "b", "<script>x</script>c"},
+		"password": {"<p>secret</p>"},
+		"empty":    {},
+	}
+	out := DefaultDefender().SanitizeValues(in)
+	assert.Equal(t, url.Values{
+		"tag":      {"a", "b", "c"},
+		"password": {"<p>secret</p>"},
+		"empty":    {},
+	}, out)
+	assert.Equal(t, "<b>a</b>", in.Get("tag"), "the input is left alone")
+	assert.Nil(t, DefaultDefender().SanitizeValues(nil))
+}
+
+func TestSanitizesFormParsedEarlier(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Request.ParseForm() })
+	r.Use(DefaultDefender().RemoveXSS())
+	r.POST("/form", func(c *gin.Context) {
+		c.JSON(200, c.Request.PostForm)
+	})
+
+	req, _ := http.NewRequest("POST", "/form", strings.NewReader("a=%3Cb%3Ex%3C%2Fb%3E&a=y&password=%3Cp%3E"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.JSONEq(t, `{"a":["x","y"],"password":["<p>"]}`, resp.Body.String())
+}
+
+func TestFormParsedEarlierIsCountedOnce(t *testing.T) {
+	var reported []string
+	tests := []struct {
+		name     string
+		defender *Defender
+		form     string
+	}{
+		{"sanitized", DefaultDefender(), "x"},
+		{"report only", DefaultDefender(SetReportOnly(func(field, before, after string) {
+			reported = append(reported, field)
+		})), "<b>x</b>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reported = nil
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(func(c *gin.Context) { c.Request.ParseForm() })
+			r.Use(tt.defender.RemoveXSS())
+			handler := func(c *gin.Context) {
+				v, _ := c.Get(SummaryContextKey)
+				c.JSON(200, gin.H{"summary": v, "form": c.Request.Form.Get("q"), "post": c.Request.PostForm.Get("q")})
+			}
+			r.GET("/form", handler)
+			r.POST("/form", handler)
+
+			for _, method := range []string{"GET", "POST"} {
+				reported = nil
+				target, body := "/form?q=%3Cb%3Ex%3C%2Fb%3E", ""
+				if method == "POST" {
+					target, body = "/form", "q=%3Cb%3Ex%3C%2Fb%3E"
+				}
+				req, _ := http.NewRequest(method, target, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				resp := httptest.NewRecorder()
+				r.ServeHTTP(resp, req)
+
+				var got struct {
+					Summary Summary
+					Form    string
+					Post    string
+				}
+				assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &got))
+				assert.Equal(t, tt.form, got.Form, method)
+				if method == "POST" {
+					assert.Equal(t, tt.form, got.Post, method)
+				}
+				if tt.defender.reporter != nil {
+					assert.Equal(t, []string{"q"}, reported, method)
+				} else {
+					assert.Equal(t, []string{"q"}, got.Summary.Modified, method)
+					assert.Equal(t, 1, got.Summary.Metrics.FieldsInspected, method)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepsRequestTrailers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(DefaultDefender().RemoveXSS())
+	r.POST("/echo", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.JSON(200, gin.H{"body": string(body), "checksum": c.Request.Trailer.Get("X-Checksum")})
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// a reader of unknown length makes the client send the body chunked, followed by the trailer
+	req, _ := http.NewRequest("POST", srv.URL+"/echo", ioutil.NopCloser(strings.NewReader(`{"a":"<b>x</b>"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	got, _ := ioutil.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"body":"{\"a\":\"x\"}","checksum":"abc"}`, string(got))
+}
+
+func TestResponseContentTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"hal", "application/hal+json", `{"_links":{"self":{"href":"/a"}},"name":"<script>x</script>bob"}`, `{"_links":{"self":{"href":"/a"}},"name":"bob"}`},
+		{"html", "text/html; charset=utf-8", `<p onclick="x()">hi</p><script>alert(1)</script>`, `<p>hi</p>`},
+		{"json not listed", "application/json", `{"name":"<b>bob</b>"}`, `{"name":"<b>bob</b>"}`},
+		{"plain not listed", "text/plain", `<b>bob</b>`, `<b>bob</b>`},
+	}
+	s := newServer(NewDefender(bluemonday.UGCPolicy(), SetResponseContentTypes("application/hal+json", "text/html")))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/response_echo", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+}
+
+func TestJsonNestedArraysOfObjects(t *testing.T) {
+	body := `[[{"a":"<b>x</b>"}],[[{"b":[{"c":"<i>y</i>"},[]]}]],[[]]]`
+	out, err := DefaultDefender().SanitizeJSONBytes([]byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, `[[{"a":"x"}],[[{"b":[{"c":"y"},[]]}]],[[]]]`, string(out))
+
+	// a panic while sanitizing fails the request with an error naming the field instead of crashing
+	defender := DefaultDefender(SetFieldTransform("b.c", func(string) string { panic("boom") }))
+	_, err = defender.SanitizeJSONBytes([]byte(body))
+	var xssErr *XSSError
+	assert.True(t, errors.As(err, &xssErr))
+	assert.Equal(t, "b.c", xssErr.Field)
+
+	s := newInboundServer(defender)
+	req, _ := http.NewRequest("POST", "/echo", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), `xss json field \"b.c\": sanitizing panicked: boom`)
+
+	// streamed bodies too
+	s = newInboundServer(DefaultDefender(SetStreamingJSON(true), SetFieldTransform("b.c", func(string) string { panic("boom") })))
+	req, _ = http.NewRequest("POST", "/echo", strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), `xss json field \"b.c\": sanitizing panicked: boom`)
+
+	// ConstructJson has no error to return, it panics with the *XSSError
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			assert.True(t, errors.As(err, &xssErr))
+			assert.Equal(t, "b.c", xssErr.Field)
+		}()
+		defender.ConstructJson(Json{"b": map[string]interface{}{"c": "x"}})
+	}()
+}
+
+func TestBodyAndQueryMethods(t *testing.T) {
+	body := `{"a":"<b>x</b>"}`
+	send := func(s *gin.Engine, method string) string {
+		req, _ := http.NewRequest(method, "/echo", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp.Body.String()
+	}
+	s := newInboundServer(DefaultDefender(SetBodyMethods(http.MethodDelete)))
+	assert.Equal(t, `{"a":"x"}`, send(s, http.MethodDelete))
+	assert.Equal(t, body, send(s, http.MethodPost))
+
+	query := func(s *gin.Engine, method string) string {
+		req, _ := http.NewRequest(method, "/query?q=%3Cb%3Ex%3C%2Fb%3E", nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		if method == http.MethodHead {
+			return resp.Header().Get("X-Query")
+		}
+		return resp.Body.String()
+	}
+	s = newInboundServer(DefaultDefender())
+	assert.Equal(t, "q=%3Cb%3Ex%3C%2Fb%3E", query(s, http.MethodHead))
+	s = newInboundServer(DefaultDefender(SetQueryMethods(http.MethodGet, http.MethodHead)))
+	assert.Equal(t, "q=x", query(s, http.MethodHead))
+	assert.Equal(t, "q=x", query(s, http.MethodGet))
+}
+
+func TestMultipartJSONFields(t *testing.T) {
+	data := `{"title":"<script>alert(1)</script>hi","tags":["<b>a</b>"],"n":1}`
+	tests := []struct {
+		name     string
+		defender *Defender
+		data     string
+		note     string
+	}{
+		{"text", DefaultDefender(), "{&#34;title&#34;:&#34;hi&#34;,&#34;tags&#34;:[&#34;a&#34;],&#34;n&#34;:1}", "1 &lt; 2"},
+		{"json", DefaultDefender(SetMultipartJSONFields("data", "note")), `{"title":"hi","tags":["a"],"n":1}`, "1 &lt; 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(tt.defender)
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			_ = writer.WriteField("data", data)
+			_ = writer.WriteField("note", "1 < 2")
+			assert.Nil(t, writer.Close())
+			req, _ := http.NewRequest("POST", "/echo", body)
+			req.Header.Add("Content-Type", writer.FormDataContentType())
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			form := parseMultipart(t, resp)
+			assert.Equal(t, tt.data, form.Value["data"][0])
+			assert.Equal(t, tt.note, form.Value["note"][0])
+		})
+	}
+}
+
+func TestMultiPartFormDataMalformed(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("a", "<b>x</b>")
+	_ = writer.WriteField("b", "<script>alert(0)</script>")
+	assert.Nil(t, writer.Close())
+	full := body.String()
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"truncated in a part", full[:strings.LastIndex(full, "alert")]},
+		{"missing closing boundary", full[:strings.LastIndex(full, "--"+writer.Boundary())]},
+		{"garbled part header", strings.Replace(full, "Content-Disposition: form-data", "Content-Disposition form-data", 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/echo", strings.NewReader(tt.body))
+			req.Header.Add("Content-Type", writer.FormDataContentType())
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 400, resp.Code)
+			assert.Contains(t, resp.Body.String(), "malformed multipart body")
+		})
+	}
+}
+
+func TestMultiPartFormDataWithoutParts(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"empty", ""},
+		{"blank", "\r\n"},
+		{"closing boundary only", "--xyz--\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender())
+			req, _ := http.NewRequest("POST", "/echo", strings.NewReader(tt.body))
+			req.Header.Add("Content-Type", "multipart/form-data; boundary=xyz")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.body, resp.Body.String())
+			assert.Equal(t, "multipart/form-data; boundary=xyz", resp.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestAllowedURLSchemes(t *testing.T) {
+	links := func() *bluemonday.Policy {
+		policy := bluemonday.NewPolicy()
+		policy.AllowAttrs("href").OnElements("a")
+		return policy
+	}
+	s := newInboundServer(NewDefender(links(), SetAllowedURLSchemes("https", "mailto")))
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"a":"<a href=\"https://example.com/\">x</a>"}`, `{"a":"<a href=\"https://example.com/\">x</a>"}`},
+		{`{"a":"<a href=\"mailto:me@example.com\">x</a>"}`, `{"a":"<a href=\"mailto:me@example.com\">x</a>"}`},
+		{`{"a":"<a href=\"javascript:alert(1)\">x</a>"}`, `{"a":"x"}`},
+		{`{"a":"<a href=\"ftp://example.com/\">x</a>"}`, `{"a":"x"}`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.body)
+	}
+
+	// the option applies to the policy whatever the order of the options
+	d := NewDefender(bluemonday.StrictPolicy(), SetAllowedURLSchemes("https"), SetPolicy(links()))
+	assert.Equal(t, "x", d.policy.Sanitize(`<a href="javascript:alert(1)">x</a>`))
+}
+
+func TestOnlySanitizeFields(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetOnlySanitizeFields("comment", "profile.bio")))
+
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"comment":"<b>x</b>","html":"<b>y</b>","profile":{"bio":"<i>z</i>","name":"<u>n</u>"},"list":[{"comment":"<p>c</p>"}],"bio":"<i>b</i>"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `{"comment":"x","html":"<b>y</b>","profile":{"bio":"z","name":"<u>n</u>"},"list":[{"comment":"c"}],"bio":"<i>b</i>"}`, resp.Body.String())
+
+	values := url.Values{}
+	values.Set("comment", "<b>x</b>")
+	values.Set("raw", "<b>y</b>")
+	req, _ = http.NewRequest("GET", "/query?"+values.Encode(), nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, "comment=x&raw=%3Cb%3Ey%3C%2Fb%3E", resp.Body.String())
+
+	// the last of SetSkipFields and SetOnlySanitizeFields wins
+	d := DefaultDefender(SetOnlySanitizeFields("a"), SetSkipFields("b"))
+	assert.Nil(t, d.onlyFields)
+	assert.Equal(t, []string{"b"}, d.skipFields)
+}
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		defender *Defender
+		body     string
+		want     string
+	}{
+		{"json", DefaultDefender(SetSniffContentType(true)), ` {"a":"<b>x</b>"}`, `{"a":"x"}`},
+		{"json array", DefaultDefender(SetSniffContentType(true)), `["<i>y</i>"]`, `["y"]`},
+		{"binary", DefaultDefender(SetSniffContentType(true)), "\x89PNG\r\n\x1a\n<b>x</b>", "\x89PNG\r\n\x1a\n<b>x</b>"},
+		{"json followed by garbage", DefaultDefender(SetSniffContentType(true)), `{"a":"<b>x</b>"}<b>`, `{"a":"<b>x</b>"}<b>`},
+		{"not sniffing", DefaultDefender(), `{"a":"<b>x</b>"}`, `{"a":"<b>x</b>"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(tt.defender)
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+}
+
+func TestFilterXSSPassesInvalidJSONThrough(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	logger := &fakeLogger{}
+	s := newServer(DefaultDefender(SetLogger(logger)))
+
+	for _, body := range []string{`{"comment":"<b>x</b>"`, ``, `<html><b>x</b></html>`} {
+		req, _ := http.NewRequest("POST", "/response_json", bytes.NewBufferString(body))
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, body, resp.Body.String())
+		assert.Equal(t, strconv.Itoa(len(body)), resp.Header().Get("Content-Length"))
+	}
+	assert.Len(t, logger.info, 3)
+}
+
+func TestDecodesCompressedBodies(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetMaxBodyBytes(1 << 10)))
+
+	compress := func(encoding, body string) *bytes.Buffer {
+		buff := new(bytes.Buffer)
+		var w io.WriteCloser
+		if encoding == "deflate" {
+			w = zlib.NewWriter(buff)
+		} else {
+			w = gzip.NewWriter(buff)
+		}
+		w.Write([]byte(body))
+		w.Close()
+		return buff
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		req, _ := http.NewRequest("POST", "/echo", compress(encoding, `{"comment":"<script>alert(0)</script>ok"}`))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Content-Encoding", encoding)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, encoding)
+		assert.Equal(t, `{"comment":"ok"}`, resp.Body.String(), encoding)
+	}
+
+	tests := []struct {
+		name string
+		body io.Reader
+	}{
+		{"not gzip", strings.NewReader(`{"comment":"<b>x</b>"}`)},
+		{"decompresses past the limit", compress("gzip", `{"comment":"`+strings.Repeat("a", 4<<10)+`"}`)},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", tt.body)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Content-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 400, resp.Code, tt.name)
+	}
+
+	// bodies that aren't sanitized are passed on compressed, even when they aren't valid
+	s.POST("/encoding", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.Header("X-Encoding", c.GetHeader("Content-Encoding"))
+		c.Data(200, "application/octet-stream", body)
+	})
+	for _, tt := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/octet-stream", compress("gzip", strings.Repeat("a", 4<<10)).Bytes()},
+		{"image/png", []byte("not gzip")},
+	} {
+		req, _ := http.NewRequest("POST", "/encoding", bytes.NewReader(tt.body))
+		req.Header.Add("Content-Type", tt.contentType)
+		req.Header.Add("Content-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, tt.contentType)
+		assert.Equal(t, "gzip", resp.Header().Get("X-Encoding"), tt.contentType)
+		assert.Equal(t, tt.body, resp.Body.Bytes(), tt.contentType)
+	}
+
+	// without SetMaxBodyBytes, what a body decompresses to is limited still
+	req, _ := http.NewRequest("POST", "/echo", compress("gzip", `{"comment":"`+strings.Repeat("a", 11<<20)+`"}`))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	newInboundServer(DefaultDefender()).ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+}
+
+// TestSafeEntities pins down how text carrying entities, comparisons and quotes comes out: entities for characters
+// the policy escapes are kept as they are, not escaped again, those characters become entities once, other entities
+// are decoded, and sanitizing the output again changes nothing.
+func TestSafeEntities(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"A &amp; B", "A &amp; B"},
+		{"A & B", "A &amp; B"},
+		{"5 < 6", "5 &lt; 6"},
+		{"5 &lt; 6", "5 &lt; 6"},
+		{`"quoted"`, "&#34;quoted&#34;"},
+		{"&#34;quoted&#34;", "&#34;quoted&#34;"},
+		{"it's", "it&#39;s"},
+		{"&copy; 2021", "© 2021"},
+	}
+	d := DefaultDefender()
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			in, _ := json.Marshal(map[string]string{"a": tt.value})
+			out, err := d.SanitizeJSONBytes(in)
+			assert.NoError(t, err)
+			var got map[string]string
+			assert.NoError(t, json.Unmarshal(out, &got))
+			assert.Equal(t, tt.want, got["a"])
+
+			again, err := d.SanitizeJSONBytes(out)
+			assert.NoError(t, err)
+			assert.Equal(t, string(out), string(again), "idempotent")
+
+			query := d.SanitizeValues(url.Values{"a": {tt.value}})
+			assert.Equal(t, tt.want, query.Get("a"))
+		})
+	}
+}
+
+func TestEntityEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding EntityEncoding
+		json     string
+		form     string
+		query    string
+	}{
+		{"escape", EscapeEntities, `{"a":"hi","b":"1 &lt; 2 &amp; &#34;3&#34;"}`, "a=hi&b=1+%26lt%3B+2+%26amp%3B+%26%2334%3B3%26%2334%3B", "a=hi&b=1+%26lt%3B+2+%26amp%3B+%26%2334%3B3%26%2334%3B"},
+		{"strip", StripEntities, `{"a":"hi","b":"1  2  3"}`, "a=hi&b=1++2++3", "a=hi&b=1++2++3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(SetEntityEncoding(tt.encoding)))
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":"<b>hi</b>","b":"1 < 2 & \"3\""}`))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.json, resp.Body.String())
+
+			req, _ = http.NewRequest("POST", "/echo", strings.NewReader("b=1+%3C+2+%26+%223%22"))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			form, _ := url.ParseQuery(resp.Body.String())
+			want, _ := url.ParseQuery(tt.form)
+			assert.Equal(t, want.Get("b"), form.Get("b"))
+
+			req, _ = http.NewRequest("GET", "/query?a=%3Cb%3Ehi%3C%2Fb%3E&b=1+%3C+2+%26+%223%22", nil)
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.query, resp.Body.String())
+		})
+	}
+
+	// markup allowed by the policy is kept
+	d := DefaultDefender(SetPolicy(bluemonday.UGCPolicy()), SetEntityEncoding(StripEntities))
+	out, err := d.SanitizeJSONBytes([]byte(`{"a":"<b>hi</b> & <script>x</script>"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"<b>hi</b>  "}`, string(out))
+}
+
+func TestNewDefenderFromName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"strict", `{"a":"hi"}`},
+		{"STRICT", `{"a":"hi"}`},
+		{"ugc", `{"a":"<b>hi</b>"}`},
+		{"none", `{"a":"<b>hi</b><script>x</script>"}`},
+	}
+	for _, tt := range tests {
+		d, err := NewDefenderFromName(tt.name, SetSkipFields("password"))
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, []string{"password"}, d.skipFields)
+
+		out, err := d.SanitizeJSONBytes([]byte(`{"a":"<b>hi</b><script>x</script>"}`))
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, string(out), tt.name)
+	}
+
+	d, err := NewDefenderFromName("lenient")
+	assert.Nil(t, d)
+	assert.EqualError(t, err, `unknown policy "lenient"`)
+}
+
+func TestResponsePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		defender *Defender
+		want     string
+	}{
+		{"main policy", DefaultDefender(), `{"a":"x","b":"y"}`},
+		{"ugc responses", DefaultDefender(SetResponsePolicy(bluemonday.UGCPolicy())), `{"a":"x","b":"<b>y</b>"}`},
+		{"unfiltered responses", DefaultDefender(SetResponsePolicy(IdentityPolicy())), `{"a":"x", "b":"<b>y</b><script>z</script>"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(tt.defender.RemoveXSS(), tt.defender.FilterXSS())
+			r.POST("/echo", func(c *gin.Context) {
+				var in struct {
+					A string `json:"a"`
+				}
+				_ = c.ShouldBindJSON(&in)
+				c.Data(200, "application/json", []byte(`{"a":"`+in.A+`", "b":"<b>y</b><script>z</script>"}`))
+			})
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"a":"<b>x</b>"}`))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			assert.Equal(t, 200, resp.Code)
+			assert.Equal(t, tt.want, resp.Body.String())
+		})
+	}
+}
+
+func TestMultiPartFormDataRebuiltWithWriter(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	// multipart.Writer refuses a boundary such as "weird@boundary", clients may still send one
+	for _, boundary := range []string{"", "weird@boundary"} {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("name", "<b>bob</b>")
+		_ = writer.WriteField("empty", "")
+		file, _ := writer.CreateFormFile("upload", `my "file".txt`)
+		file.Write([]byte("<raw>\r\n--not-a-boundary\r\n"))
+		assert.Nil(t, writer.Close())
+
+		contentType := writer.FormDataContentType()
+		if boundary != "" {
+			body = bytes.NewBufferString(strings.ReplaceAll(body.String(), writer.Boundary(), boundary))
+			contentType = `multipart/form-data; boundary="` + boundary + `"`
+		}
+
+		req, _ := http.NewRequest("POST", "/echo", body)
+		req.Header.Add("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code, boundary)
+		form := parseMultipart(t, resp)
+		assert.Equal(t, []string{"bob"}, form.Value["name"])
+		assert.Equal(t, []string{""}, form.Value["empty"])
+		assert.Equal(t, `my "file".txt`, form.File["upload"][0].Filename)
+		f, _ := form.File["upload"][0].Open()
+		content, _ := ioutil.ReadAll(f)
+		assert.Equal(t, "<raw>\r\n--not-a-boundary\r\n", string(content))
+	}
+}
+
+func TestMaxQueryParams(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetMaxQueryParams(3)))
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"a=1&b=2&c=%3Cb%3E3%3C%2Fb%3E", 200},
+		{"a=1&b=2&c=3&d=4", 400},
+		{strings.Repeat("a=1&", 10000) + "a=1", 400},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/query?"+tt.query, nil)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, tt.code, resp.Code)
+		if tt.code == 400 {
+			assert.Contains(t, resp.Body.String(), "too many query parameters")
+		} else {
+			assert.Equal(t, "a=1&b=2&c=3", resp.Body.String())
+		}
+	}
+}
+
+func TestSkipFieldsKeepNestedStructure(t *testing.T) {
+	body := `{"doc":{"title":"<h1>T</h1>","blocks":[{"html":"<p onclick=\"x()\">a</p>"},["<b>b</b>",2.0,null]],"meta":{}},"title":"<h1>T</h1>"}`
+	want := `{"doc":{"title":"<h1>T</h1>","blocks":[{"html":"<p onclick=\"x()\">a</p>"},["<b>b</b>",2.0,null]],"meta":{}},"title":"T"}`
+
+	for _, streaming := range []bool{false, true} {
+		s := newInboundServer(DefaultDefender(SetSkipFields("doc"), SetStreamingJSON(streaming)))
+
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, want, resp.Body.String(), "streaming %v", streaming)
+	}
+}
+
+func TestSummaryInContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(DefaultDefender().RemoveXSS())
+	r.POST("/summary", func(c *gin.Context) {
+		v, ok := c.Get(SummaryContextKey)
+		assert.True(t, ok)
+		c.JSON(200, v)
+	})
+
+	req, _ := http.NewRequest("POST", "/summary", bytes.NewBufferString(`{"a":"<b>x</b>","b":"y","c":{"d":"<i>z</i>"}}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	var summary Summary
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &summary))
+	assert.Equal(t, Summary{
+		Modified: []string{"a", "c.d"},
+		Metrics:  Metrics{FieldsInspected: 3, FieldsModified: 2, BytesIn: 17, BytesOut: 3},
+	}, summary)
+}
+
+func TestFieldTransform(t *testing.T) {
+	s := newInboundServer(DefaultDefender(
+		SetFieldTransform("email", strings.ToLower),
+		// the policy sanitizes what the transform returns
+		SetFieldTransform("post.body", func(v string) string { return strings.TrimSpace(v) + "<script>x</script>" }),
+	))
+
+	req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"email":"Bob@Example.COM","post":{"body":"  <b>hi</b> ","email":"A@B.C"},"body":" x "}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `{"email":"bob@example.com","post":{"body":"hi","email":"a@b.c"},"body":" x "}`, resp.Body.String())
+
+	req, _ = http.NewRequest("POST", "/echo", strings.NewReader("email=Bob%40Example.COM"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, "email=bob%40example.com", resp.Body.String())
+
+	// transforms alone don't count as modifications
+	s = newInboundServer(DefaultDefender(SetFieldTransform("email", strings.ToLower), SetRejectOnModification(true)))
+	req, _ = http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"email":"Bob@Example.COM"}`))
+	req.Header.Add("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Equal(t, `{"email":"bob@example.com"}`, resp.Body.String())
+}
+
+func TestMultiPartMixed(t *testing.T) {
+	s := newInboundServer(DefaultDefender())
+
+	for _, subtype := range []string{"mixed", "related"} {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		text, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+		text.Write([]byte("<p>hi</p><script>alert(0)</script>"))
+		plain, _ := writer.CreatePart(textproto.MIMEHeader{})
+		plain.Write([]byte("<b>x</b>"))
+		binary, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/png"}})
+		binary.Write([]byte("\x89PNG<script>"))
+		assert.Nil(t, writer.Close())
+
+		req, _ := http.NewRequest("POST", "/echo", body)
+		req.Header.Add("Content-Type", "multipart/"+subtype+"; boundary="+writer.Boundary())
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		assert.Equal(t, 200, resp.Code)
+
+		reader := multipart.NewReader(resp.Body, writer.Boundary())
+		var got []string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			content, _ := ioutil.ReadAll(part)
+			got = append(got, part.Header.Get("Content-Type")+"|"+string(content))
+		}
+		assert.Equal(t, []string{"text/html; charset=utf-8|hi", "|x", "image/png|\x89PNG<script>"}, got, subtype)
+	}
+}
+
+func TestFormatIndicator(t *testing.T) {
+	s := newInboundServer(DefaultDefender(SetFormatIndicator("_format", "html")))
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"body":"<b>x</b>","body_format":"html"}`, `{"body":"x","body_format":"html"}`},
+		{`{"body":"<b>x</b>","body_format":"markdown"}`, `{"body":"<b>x</b>","body_format":"markdown"}`},
+		{`{"body_format":"text","body":"a < b"}`, `{"body_format":"text","body":"a < b"}`},
+		{`{"body":"<b>x</b>","body_format":null}`, `{"body":"<b>x</b>","body_format":null}`},
+		{`{"body":"<b>x</b>","title":"<i>t</i>"}`, `{"body":"x","title":"t"}`},
+		{`{"post":{"body":"<b>x</b>","body_format":"text"},"body":"<b>y</b>"}`, `{"post":{"body":"<b>x</b>","body_format":"text"},"body":"y"}`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(tt.body))
+		req.Header.Add("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.body)
+	}
+}
+
+func TestMultiPartFormDataBudget(t *testing.T) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("small", "<b>x</b>")
+	_ = writer.WriteField("large", strings.Repeat("a", 2048))
+	assert.Nil(t, writer.Close())
+
+	t.Run("client stalls mid-read", func(t *testing.T) {
+		// the client sends half of the body, then nothing, the read it blocks must end with the request
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go pw.Write(body.Bytes()[:body.Len()/2])
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, "POST", "/echo", pr)
+		req.Header.Add("Content-Type", writer.FormDataContentType())
+
+		start := time.Now()
+		err := DefaultDefender().handleMultiPartFormData(req, writer.FormDataContentType())
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+
+	tests := []struct {
+		name     string
+		maxBytes int64
+		code     int
+	}{
+		{"no cap", 0, 200},
+		{"under the cap", 4096, 200},
+		{"over the cap", 1024, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(DefaultDefender(SetMaxPartBytes(tt.maxBytes)))
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewReader(body.Bytes()))
+			req.Header.Add("Content-Type", writer.FormDataContentType())
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.code, resp.Code)
+			if tt.code == 400 {
+				assert.Contains(t, resp.Body.String(), "multipart part too large")
+			}
+		})
+	}
+}
+
+func TestMaxMultipartParts(t *testing.T) {
+	form := func(parts int) (*bytes.Buffer, string) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		for i := 0; i < parts; i++ {
+			_ = writer.WriteField(fmt.Sprintf("f%d", i), "<b>x</b>")
+		}
+		assert.Nil(t, writer.Close())
+		return body, writer.FormDataContentType()
+	}
+
+	tests := []struct {
+		name     string
+		defender *Defender
+		parts    int
+		code     int
+	}{
+		{"default", DefaultDefender(), 1000, 200},
+		{"over the default", DefaultDefender(), 1001, 400},
+		{"at the limit", DefaultDefender(SetMaxMultipartParts(3)), 3, 200},
+		{"over the limit", DefaultDefender(SetMaxMultipartParts(3)), 4, 400},
+		{"no limit", DefaultDefender(SetMaxMultipartParts(0)), 1500, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(tt.defender)
+			body, contentType := form(tt.parts)
+			req, _ := http.NewRequest("POST", "/echo", body)
+			req.Header.Add("Content-Type", contentType)
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tt.code, resp.Code)
+			if tt.code == 400 {
+				assert.Contains(t, resp.Body.String(), "too many multipart parts")
+			}
+		})
+	}
+}
+
+func TestPolicyConfigurer(t *testing.T) {
+	d := DefaultDefender(
+		SetPolicyConfigurer(func(policy *bluemonday.Policy) {
+			policy.AllowElements("b")
+		}),
+		SetPolicyConfigurer(func(policy *bluemonday.Policy) {
+			policy.AllowComments()
+		}),
+	)
+
+	out, err := d.SanitizeJSONBytes([]byte(`{"a":"<b>bold</b> <i>it</i><!--[if IE]>x<![endif]--><script>x</script>"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"<b>bold</b> it<!--[if IE]>x<![endif]-->"}`, string(out))
+
+	// other Defenders keep the policy as it was
+	out, err = DefaultDefender().SanitizeJSONBytes([]byte(`{"a":"<b>bold</b>"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"bold"}`, string(out))
+}
+
+func TestXSSError(t *testing.T) {
+	largeBody := new(bytes.Buffer)
+	writer := multipart.NewWriter(largeBody)
+	_ = writer.WriteField("bio", strings.Repeat("a", 64))
+	assert.Nil(t, writer.Close())
+
+	tests := []struct {
+		name     string
+		defender *Defender
+		method   string
+		target   string
+		ct       string
+		body     string
+		phase    string
+		field    string
+		cause    error
+	}{
+		{"json", DefaultDefender(SetMaxJSONDepth(1)), "POST", "/echo", "application/json", `[[1]]`, "json", "", errTooDeep},
+		{"form", DefaultDefender(SetMaxBodyBytes(4)), "POST", "/echo", "application/x-www-form-urlencoded", "a=12345", "form", "", nil},
+		{"multipart", DefaultDefender(SetMaxPartBytes(8)), "POST", "/echo", writer.FormDataContentType(), largeBody.String(), "multipart", "bio", errPartTooLarge},
+		{"multipart without boundary", DefaultDefender(), "POST", "/echo", "multipart/form-data", "", "multipart", "", errNoBoundary},
+		{"query", DefaultDefender(SetMaxQueryParams(1)), "GET", "/query?a=1&b=2", "", "", "query", "", errTooManyParams},
+		{"body", DefaultDefender(), "POST", "/echo", "application/json", "not gzip", "body", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.ct != "" {
+				req.Header.Set("Content-Type", tt.ct)
+			}
+			if tt.phase == "body" {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+
+			_, err := tt.defender.sanitizeRequest(req)
+			var xssErr *XSSError
+			assert.True(t, errors.As(err, &xssErr), err)
+			assert.Equal(t, tt.phase, xssErr.Phase)
+			assert.Equal(t, tt.field, xssErr.Field)
+			if tt.cause != nil {
+				assert.True(t, errors.Is(err, tt.cause))
+			}
+		})
+	}
+
+	// the exported handlers return it too
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/", strings.NewReader(`[[1]]`))
+	err := DefaultDefender(SetMaxJSONDepth(1)).HandleJson(c)
+	assert.EqualError(t, err, "xss json: json nested too deeply")
+}
+
+func TestXFormEncodedRoundTrip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(DefaultDefender().RemoveXSS())
+	r.PUT("/length", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		assert.Equal(t, int64(len(body)), c.Request.ContentLength)
+		assert.Equal(t, strconv.Itoa(len(body)), c.GetHeader("Content-Length"))
+		c.String(200, string(body))
+	})
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"b=two+words&a=two%20words", "b=two+words&a=two%20words"},
+		{"q=a%2Bb&q=%3Cb%3Ec%3C%2Fb%3E&q=d", "q=a%2Bb&q=c&q=d"},
+		{"first%20name=Jos%C3%A9&x%5B%5D=1&x%5B%5D=2", "first%20name=Jos%C3%A9&x%5B%5D=1&x%5B%5D=2"},
+		{"note=1+%3C+2&flag&empty=", "note=1+%26lt%3B+2&flag&empty="},
+		{"password=%3Cp%3E&b=%3Ci%3Ex%3C%2Fi%3E", "password=%3Cp%3E&b=x"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("PUT", "/length", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ContentLength = int64(len(tt.body))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		assert.Equal(t, 200, resp.Code)
+		assert.Equal(t, tt.want, resp.Body.String(), tt.body)
+	}
+}
+
+func TestSkipFieldsCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		name     string
+		defender *Defender
+		json     string
+		form     string
+		query    string
+	}{
+		{
+			"exact", DefaultDefender(SetSkipFields("password", "user.apiKey")),
+			`{"password":"<p>","Password":"","PASSWORD":"","user":{"apiKey":"<k>","APIKEY":""}}`,
+			"password=%3Cp%3E&Password=&PASSWORD=",
+			"password=%3Cp%3E&Password=&PASSWORD=",
+		},
+		{
+			"case insensitive", DefaultDefender(SetSkipFields("password", "user.apiKey"), SetSkipFieldsCaseInsensitive(true)),
+			`{"password":"<p>","Password":"<p>","PASSWORD":"<p>","user":{"apiKey":"<k>","APIKEY":"<k>"}}`,
+			"password=%3Cp%3E&Password=%3Cp%3E&PASSWORD=%3Cp%3E",
+			"password=%3Cp%3E&Password=%3Cp%3E&PASSWORD=%3Cp%3E",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newInboundServer(tt.defender)
+
+			req, _ := http.NewRequest("POST", "/echo", bytes.NewBufferString(`{"password":"<p>","Password":"<p>","PASSWORD":"<p>","user":{"apiKey":"<k>","APIKEY":"<k>"}}`))
+			req.Header.Add("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.json, resp.Body.String())
+
+			req, _ = http.NewRequest("POST", "/echo", strings.NewReader("password=%3Cp%3E&Password=%3Cp%3E&PASSWORD=%3Cp%3E"))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.form, resp.Body.String())
+
+			req, _ = http.NewRequest("GET", "/query?password=%3Cp%3E&Password=%3Cp%3E&PASSWORD=%3Cp%3E", nil)
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tt.query, resp.Body.String())
+
+			body := new(bytes.Buffer)
+			writer := multipart.NewWriter(body)
+			_ = writer.WriteField("Password", "<p>")
+			assert.Nil(t, writer.Close())
+			req, _ = http.NewRequest("POST", "/echo", body)
+			req.Header.Add("Content-Type", writer.FormDataContentType())
+			resp = httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			form := parseMultipart(t, resp)
+			if tt.defender.skipFieldsFold {
+				assert.Equal(t, "<p>", form.Value["Password"][0])
+			} else {
+				assert.Equal(t, "", form.Value["Password"][0])
+			}
+		})
+	}
+}